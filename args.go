@@ -32,7 +32,8 @@ const (
 	maxReconnect = time.Minute * 2
 )
 
-func init() {
+// parseArgs parses the command-line (and environment) into 'settings'
+func parseArgs() {
 	arg.MustParse(&settings)
 
 	if settings.Echo != nil {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -65,7 +68,7 @@ func (auth Auth) VerifyAuthorization(r *http.Request) error {
 
 		creds := strings.SplitN(string(decoded), ":", 2)
 		if len(creds) == 2 {
-			if auth.Basic[creds[0]] == creds[1] {
+			if password, ok := auth.Basic[creds[0]]; ok && password == creds[1] {
 				return nil
 			}
 			return invalidAuthUnknown
@@ -73,10 +76,43 @@ func (auth Auth) VerifyAuthorization(r *http.Request) error {
 		return invalidAuthBasic
 
 	case "bearer":
-		if parts[1] == auth.Bearer {
+		if auth.Bearer != "" && parts[1] == auth.Bearer {
 			return nil
 		}
 		return invalidAuthBearer
 	}
 	return errAuthMalformed
 }
+
+// the identity of a caller without (verified) credentials is its address
+const anonymousPrefix = "anon:"
+
+// Identity returns who the caller is ('basic:USER', 'bearer:HASH' or 'anon:IP'),
+// credentials are only used when they have been verified, otherwise the caller is anonymous
+func (auth Auth) Identity(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) == 2 && !auth.Anonymous && auth.VerifyAuthorization(r) == nil {
+		switch strings.ToLower(parts[0]) {
+		case "basic":
+			if decoded, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+				creds := strings.SplitN(string(decoded), ":", 2)
+				return "basic:" + creds[0]
+			}
+		case "bearer":
+			// never expose the token itself
+			sum := sha256.Sum256([]byte(parts[1]))
+			return "bearer:" + hex.EncodeToString(sum[:4])
+		}
+	}
+
+	return anonymousPrefix + clientIP(r)
+}
+
+// clientIP returns the address of the caller (without port)
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
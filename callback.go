@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -18,6 +19,9 @@ func init() {
 	netClient.RetryMax = 5
 	netClient.RetryWaitMin = time.Millisecond * 500
 	netClient.RetryWaitMax = time.Second * 3
+	netClient.Logger = new(httpLogger)
+	// keep the last response when all retries fail (so the status is known)
+	netClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
 }
 
 type httpLogger struct{}
@@ -52,15 +56,48 @@ func expandMap(txt string, vars map[string]string) string {
 
 var melpUserAgent = fmt.Sprintf("melp-%s", versionFunc())
 
+// callbackError is a callback that responded with a non-2xx status
+type callbackError struct {
+	StatusCode int
+	Status     string
+	// Terminal is a status that will never succeed (see 'retry.terminal')
+	Terminal bool
+}
+
+func (err *callbackError) Error() string {
+	return err.Status
+}
+
+// httpClient returns the client of the retry-policy, or the shared one
+func (callback *melpCallback) httpClient() *retryablehttp.Client {
+	if callback.client != nil {
+		return callback.client
+	}
+	return netClient
+}
+
 func (callback *melpCallback) Send(message *Message) error {
-	netClient.Logger = new(httpLogger)
+	return callback.post(message.Metadata, message.Body, func(hdr http.Header) {
+		for k, v := range message.Metadata {
+			hdr.Add(fmt.Sprintf("melp-%s", k), v)
+		}
+
+		for _, h := range callback.messageHeaders(message) {
+			hdr.Add(h.Key, encodeHeaderValue(h.Value))
+		}
+	}, nil)
+}
+
+// post sends the body to the callback, 'vars' are used to expand the url.
+// If 'result' is set, the JSON-response is decoded into it.
+func (callback *melpCallback) post(vars map[string]string, body []byte, headers func(http.Header), result interface{}) error {
 
 	log.Trace().Msgf("Send-> preparing to send message to '%s'...", callback.URL)
 
 	// target := os.Expand(callback.URL, func(key string) string {
 	// 	return message.Metadata[key]
 	// })
-	target := expandMap(callback.URL, message.Metadata)
+	target := expandMap(callback.URL, vars)
 	if _, err := url.Parse(target); err != nil {
 		return fmt.Errorf("invalid url: %s", target)
 	}
@@ -71,7 +108,7 @@ func (callback *melpCallback) Send(message *Message) error {
 
 	//resp, err := netClient.Post(url, message.ContentType(), buffer)
 
-	req, err := retryablehttp.NewRequest("POST", target, message.Body)
+	req, err := retryablehttp.NewRequest("POST", target, body)
 	if err != nil {
 		log.Error().Msgf("create request failed: %v", err)
 		return err
@@ -97,28 +134,59 @@ func (callback *melpCallback) Send(message *Message) error {
 		req.Header.Add(k, v)
 	}
 
-	for k, v := range message.Metadata {
-		req.Header.Add(fmt.Sprintf("melp-%s", k), v)
-	}
+	headers(req.Header)
 
-	for k, v := range message.Headers {
-		req.Header.Add(k, v)
-	}
+	ctx, cancel := callback.Retry.Context()
+	defer cancel()
 
-	resp, err := netClient.Do(req)
+	resp, err := callback.httpClient().Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
 
 	if err != nil {
 		log.Error().Msgf("send failed: %v", err)
 		return err
 	}
 
-	if resp != nil {
-		log.Debug().Msgf("Send-> send-response = %d", resp.StatusCode)
+	log.Debug().Msgf("Send-> send-response = %d", resp.StatusCode)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > 299 {
+		if callback.Retry.IsSkipped(resp.StatusCode) {
+			log.Warn().Msgf("Send-> '%s' responded %s, message skipped", target, resp.Status)
+			return nil
+		}
+		return &callbackError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Terminal:   callback.Retry.IsTerminal(resp.StatusCode),
+		}
 	}
 
-	if err == nil && (resp.StatusCode < http.StatusOK || resp.StatusCode > 299) {
-		return fmt.Errorf(resp.Status)
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return fmt.Errorf("invalid response: %w", err)
+		}
 	}
 
-	return err
+	return nil
+}
+
+// messageHeaders returns the headers of the message, filtered by the header-rules of the callback
+func (callback *melpCallback) messageHeaders(message *Message) []Header {
+	rules := callback.HeaderRules
+	if rules == nil {
+		return message.Headers
+	}
+
+	// work on a copy, the message itself is left untouched
+	filtered := *message
+	filtered.Headers = nil
+	for _, h := range message.Headers {
+		if rules.Passes(h.Key, true) {
+			filtered.AddRawHeader(h.Key, h.Value)
+		}
+	}
+	rules.Transform(&filtered, newMessageContext(message, nil))
+	return filtered.Headers
 }
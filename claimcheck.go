@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Machine-readable error-codes for claim-checks
+const (
+	codeClaimCheckFailed = "claim-check-failed"
+)
+
+const (
+	defaultClaimThreshold = 500000
+	// with a claim-check the body can be much larger than a Kafka-message
+	defaultClaimMaxBodyBytes = 100 * 1024 * 1024
+
+	claimCheckHeader = "Melp-Claim-Check"
+)
+
+var (
+	errInvalidClaimKey = stringError("invalid claim-check key")
+	errClaimMismatch   = stringError("claim-check payload does not match the reference")
+)
+
+// valid keys of stored payloads (never absolute or with '..')
+var validClaimKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+
+// blobStore is where payloads of claim-checks are kept
+type blobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// claimCheckConfig stores large bodies in a blob-store, and sends a reference instead
+type claimCheckConfig struct {
+	Threshold int       `json:"threshold" yaml:"threshold"`
+	Dir       string    `json:"dir" yaml:"dir"`
+	S3        *s3Config `json:"s3" yaml:"s3"`
+
+	store blobStore
+}
+
+func (cfg *claimCheckConfig) Validate(name string) []error {
+	var errs []error
+
+	if cfg.Threshold == 0 {
+		cfg.Threshold = defaultClaimThreshold
+	}
+	if cfg.Threshold < 0 {
+		errs = append(errs, invalidError(name+".threshold"))
+	}
+
+	switch {
+	case cfg.Dir != "" && cfg.S3 != nil:
+		errs = append(errs, fmt.Errorf("'%s' can only have one of 'dir' or 's3'", name))
+	case cfg.Dir != "":
+		cfg.store = &localStore{dir: cfg.Dir}
+	case cfg.S3 != nil:
+		errs = append(errs, cfg.S3.Validate(name+".s3")...)
+		cfg.store = newS3Store(cfg.S3)
+	default:
+		errs = append(errs, requiredError(name+".dir"))
+	}
+
+	return errs
+}
+
+// ValidatePrefix checks that the id of the producer can be used as the first part of the keys
+func (cfg *claimCheckConfig) ValidatePrefix(id string) error {
+	if !validClaimKey.MatchString(id) || strings.Contains(id, "..") || strings.Contains(id, "/") {
+		return fmt.Errorf("'claimCheck' requires an id with only letters, digits, '_', '.' and '-' (not '%s')", id)
+	}
+	return nil
+}
+
+// claimReference is the body of the message that is sent instead of the payload
+type claimReference struct {
+	ClaimCheck string `json:"claimCheck"`
+	Size       int    `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+// Store the payload, and returns the reference to send instead
+func (cfg *claimCheckConfig) Store(prefix string, payload []byte) (string, []byte, error) {
+	key := fmt.Sprintf("%s/%s/%s", prefix, time.Now().UTC().Format("2006/01/02"), newMessageID())
+	if err := cfg.store.Put(key, payload); err != nil {
+		return "", nil, err
+	}
+
+	ref, err := json.Marshal(&claimReference{
+		ClaimCheck: key,
+		Size:       len(payload),
+		SHA256:     sha256Hex(payload),
+	})
+	return key, ref, err
+}
+
+// Resolve replaces the reference in the message with the stored payload
+func (cfg *claimCheckConfig) Resolve(msg *Message) error {
+	key := msg.GetHeader(claimCheckHeader)
+	if key == "" {
+		return nil
+	}
+	if !validClaimKey.MatchString(key) || strings.Contains(key, "..") {
+		return errInvalidClaimKey
+	}
+
+	var ref claimReference
+	if err := json.Unmarshal(msg.Body, &ref); err != nil {
+		return fmt.Errorf("invalid claim-check reference: %w", err)
+	}
+
+	payload, err := cfg.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if ref.ClaimCheck != key || len(payload) != ref.Size || sha256Hex(payload) != ref.SHA256 {
+		return errClaimMismatch
+	}
+
+	msg.Body = payload
+	msg.DelHeader(claimCheckHeader)
+	return nil
+}
+
+// claimCheck stores a large body and replaces it with a reference, returns the key (or "" if not stored)
+func (p *kafkaProducer) claimCheck(msg *Message) (string, error) {
+	if p.ClaimCheck == nil || len(msg.Body) <= p.ClaimCheck.Threshold || msg.Metadata[TOMBSTONE] != "" {
+		return "", nil
+	}
+
+	key, ref, err := p.ClaimCheck.Store(p.ID, msg.Body)
+	if err != nil {
+		return "", newProblem(http.StatusBadGateway, codeClaimCheckFailed, err)
+	}
+	msg.Body = ref
+	return key, nil
+}
+
+// localStore keeps blobs as files in a directory
+type localStore struct {
+	dir string
+}
+
+func (store *localStore) Put(key string, data []byte) error {
+	name := filepath.Join(store.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".tmp", data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (store *localStore) Get(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(store.dir, filepath.FromSlash(key)))
+}
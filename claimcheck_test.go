@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestClaimCheckRoundTrip(t *testing.T) {
+	s3 := &s3Config{Bucket: "blobs", AccessKey: "key", SecretKey: "secret"}
+	newFakeS3(t, s3)
+
+	for name, cfg := range map[string]*claimCheckConfig{
+		"dir": {Dir: t.TempDir()},
+		"s3":  {S3: s3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if errs := cfg.Validate("claimCheck"); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+
+			payload := bytes.Repeat([]byte("x"), 1000)
+			key, ref, err := cfg.Store("producer-1", payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := &Message{Body: ref}
+			msg.AddHeader(claimCheckHeader, key)
+			if err := cfg.Resolve(msg); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg.Body, payload) {
+				t.Error("resolved body is not the payload")
+			}
+			if msg.GetHeader(claimCheckHeader) != "" {
+				t.Error("claim-check header is still set")
+			}
+
+			// a reference that doesn't match the payload
+			_, ref2, err := cfg.Store("producer-1", []byte("other"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg = &Message{Body: ref2}
+			msg.AddHeader(claimCheckHeader, key)
+			if err := cfg.Resolve(msg); err != errClaimMismatch {
+				t.Errorf("Resolve = %v, want %v", err, errClaimMismatch)
+			}
+		})
+	}
+}
+
+func TestClaimCheckInvalidKey(t *testing.T) {
+	cfg := &claimCheckConfig{Dir: t.TempDir()}
+	if errs := cfg.Validate("claimCheck"); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	for _, key := range []string{"../etc/passwd", "/abs/path", "a/../b", "a//b", "a b"} {
+		msg := &Message{Body: []byte("{}")}
+		msg.AddHeader(claimCheckHeader, key)
+		if err := cfg.Resolve(msg); err != errInvalidClaimKey {
+			t.Errorf("Resolve(%q) = %v, want %v", key, err, errInvalidClaimKey)
+		}
+	}
+}
+
+func TestClaimCheckProducerID(t *testing.T) {
+	cfg := &claimCheckConfig{}
+	for id, valid := range map[string]bool{"orders": true, "orders-v2.eu_1": true, "orders/eu": false, "my orders": false, "..": false, "": false} {
+		if err := cfg.ValidatePrefix(id); (err == nil) != valid {
+			t.Errorf("ValidatePrefix(%q) = %v", id, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -39,16 +40,41 @@ func (name invalidError) Error() string {
 	return fmt.Sprintf("'%s' is invalid", string(name))
 }
 
+// statusCoder is implemented by responses that should not be sent with 200 OK
+type statusCoder interface {
+	StatusCode() int
+}
+
 // Producer is the definition of something that send messages
 type Producer interface {
 	Name() string
 	Validate() ([]error, bool)
 	Connect() (Producer, error)
 	Send(Message, *http.Request) (interface{}, error)
+	SendBatch([]Message, *http.Request) ([]batchResult, error)
+	Delivery(id string) *deliveryStatus
+	Idempotency() *idempotencyStore
+	Limiter() *rateLimiter
+	HeaderRules() *headerRules
+	MaxBodyBytes() int64
+	MaxBatchBytes() int64
+	Identity(*http.Request) string
 	Close() error
 	Authorize(*http.Request) (bool, error)
 }
 
+// batchResult is the result of one message of a batch
+type batchResult struct {
+	ID        string `json:"id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	Targets []targetBatchResult `json:"targets,omitempty"`
+}
+
 // Consumer is the definition of something reveiving messages
 type Consumer interface {
 	Name() string
@@ -58,12 +84,18 @@ type Consumer interface {
 	Close() error
 }
 
+// Header is a message-header, the same key can occur several times and the value can be binary
+type Header struct {
+	Key   string
+	Value []byte
+}
+
 // Message is the data that is sent or received
 type Message struct {
 	Body      []byte
 	Timestamp time.Time
 	Metadata  map[string]string
-	Headers   map[string]string
+	Headers   []Header
 }
 
 // AddMetadata adds metadata (key+value) to the message
@@ -74,25 +106,56 @@ func (msg *Message) AddMetadata(key, value string) {
 	msg.Metadata[key] = value
 }
 
-// AddHeader adds header(s) (key+value) to the message,
-// all keys are converted using http.CanonicalHeaderKey
+// AddHeader adds a header (key+value) to the message,
+// the key is converted using http.CanonicalHeaderKey
 func (msg *Message) AddHeader(key, value string) {
 	if key == "" || value == "" {
 		return
 	}
-	if msg.Headers == nil {
-		msg.Headers = make(map[string]string)
+	msg.AddRawHeader(http.CanonicalHeaderKey(key), []byte(value))
+}
+
+// AddHTTPHeader adds a header from an HTTP-request, binary values are decoded (see encodeHeaderValue)
+func (msg *Message) AddHTTPHeader(key, value string) {
+	if key == "" {
+		return
+	}
+	msg.AddRawHeader(http.CanonicalHeaderKey(key), decodeHeaderValue(value))
+}
+
+// AddRawHeader adds a header exactly as it is (like a Kafka-header)
+func (msg *Message) AddRawHeader(key string, value []byte) {
+	msg.Headers = append(msg.Headers, Header{Key: key, Value: value})
+}
+
+// SetHeader replaces all headers with the key
+func (msg *Message) SetHeader(key, value string) {
+	msg.DelHeader(key)
+	msg.AddHeader(key, value)
+}
+
+// DelHeader removes all headers with the key (case-insensitive)
+func (msg *Message) DelHeader(key string) {
+	var hdrs []Header
+	for _, h := range msg.Headers {
+		if !strings.EqualFold(h.Key, key) {
+			hdrs = append(hdrs, h)
+		}
 	}
-	msg.Headers[http.CanonicalHeaderKey(key)] = value
+	msg.Headers = hdrs
 }
 
-// GetHeader returns the header value of a specific key
-// (the key is converted using http.CanonicalHeaderKey before match)
+// GetHeader returns the (first) header value of a specific key (case-insensitive)
 func (msg *Message) GetHeader(key string) string {
-	return msg.Headers[http.CanonicalHeaderKey(key)]
+	for _, h := range msg.Headers {
+		if strings.EqualFold(h.Key, key) {
+			return string(h.Value)
+		}
+	}
+	return ""
 }
 
 // ContentType returns the content-type of the message
 func (msg *Message) ContentType() string {
-	return msg.Headers["Content-Type"]
+	return msg.GetHeader("Content-Type")
 }
@@ -31,7 +31,8 @@ type metricsConfig struct {
 }
 
 type melpProducer struct {
-	Kafka []*melpKafkaOutputConfig `json:"kafka" yaml:"kafka"`
+	Kafka  []*melpKafkaOutputConfig `json:"kafka" yaml:"kafka"`
+	Fanout []*melpFanoutConfig      `json:"fanout" yaml:"fanout"`
 }
 
 type melpConsumer struct {
@@ -127,6 +128,18 @@ func (cfg *melpConfig) Load(name string) bool {
 		}
 	}
 
+	for i, output := range cfg.Producing.Fanout {
+		errs, active := output.Validate()
+		if printErrors(errs, "Error validating fanout #%d:", i) {
+			ok = false
+		} else {
+			if active {
+				inUse++
+				outputMap[output.ID]++
+			}
+		}
+	}
+
 	for i, input := range cfg.Consuming.Kafka {
 		errs, active := input.Validate()
 		if active {
@@ -171,6 +184,17 @@ func (cfg *melpConfig) Connect() bool {
 		}
 	}
 
+	for _, output := range cfg.Producing.Fanout {
+		fp, err := output.NewProducer()
+		if err != nil {
+			ok = false
+		}
+
+		if fp != nil {
+			cfg.outputs[fp.Name()] = fp
+		}
+	}
+
 	for _, input := range cfg.Consuming.Kafka {
 		kc, errs := input.NewReceiver()
 		if errs != nil {
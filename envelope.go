@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// envelopeContentType is the content-type of a body with the message (and its key, headers...) as one JSON-document
+const envelopeContentType = "application/vnd.melp.envelope+json"
+
+var errEnvelopeValue = stringError("'value' and 'valueBase64' can't both be set")
+
+// envelope is a message with its key, headers, partition and timestamp,
+// used for 'application/vnd.melp.envelope+json' and for each message in a batch
+type envelope struct {
+	Key         string                  `json:"key"`
+	Headers     map[string]headerValues `json:"headers"`
+	Partition   *int32                  `json:"partition"`
+	Timestamp   json.RawMessage         `json:"timestamp"`
+	Value       json.RawMessage         `json:"value"`
+	ValueBase64 string                  `json:"valueBase64"`
+	Tombstone   bool                    `json:"tombstone"`
+}
+
+// headerValues is either a single value or a list of values
+type headerValues []string
+
+func (hv *headerValues) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*hv = headerValues{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(hv))
+}
+
+// isEnvelope is true if the body of the request is an envelope
+func isEnvelope(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == envelopeContentType
+}
+
+// Apply sets the body, key, headers, partition and timestamp of the message,
+// the headers must pass the header-rules (in the same way as the headers of the request)
+func (env *envelope) Apply(msg *Message, rules *headerRules) *problem {
+	switch {
+	case len(env.Value) > 0 && env.ValueBase64 != "":
+		return newProblem(http.StatusBadRequest, codeInvalidRequest, errEnvelopeValue)
+	case env.ValueBase64 != "":
+		value, err := base64.StdEncoding.DecodeString(env.ValueBase64)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("'valueBase64' is invalid: %w", err))
+		}
+		msg.Body = value
+	default:
+		msg.Body = env.Value
+	}
+
+	if env.Tombstone {
+		if len(msg.Body) > 0 {
+			return newProblem(http.StatusBadRequest, codeInvalidRequest, errTombstoneBody)
+		}
+		msg.Body = nil
+		msg.AddMetadata(TOMBSTONE, "true")
+	}
+
+	for k, vs := range env.Headers {
+		if !rules.Passes(k, true) {
+			continue
+		}
+		msg.DelHeader(k)
+		for _, v := range vs {
+			msg.AddHTTPHeader(k, v)
+		}
+	}
+
+	if env.Key != "" {
+		msg.AddMetadata(PartitionKey, env.Key)
+	}
+	if env.Partition != nil {
+		msg.AddMetadata(PARTITION, strconv.FormatInt(int64(*env.Partition), 10))
+	}
+
+	if len(env.Timestamp) > 0 && string(env.Timestamp) != "null" {
+		// either a string (RFC 3339 or epoch-milliseconds) or a number
+		var text string
+		if err := json.Unmarshal(env.Timestamp, &text); err != nil {
+			text = string(env.Timestamp)
+		}
+		ts, err := parseTimestamp(text)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, codeInvalidTimestamp, err)
+		}
+		msg.Timestamp = ts
+	}
+
+	return nil
+}
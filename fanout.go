@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ninlil/butler/log"
+)
+
+// Delivery-policies of a fan-out producer
+const (
+	policyAll        = "all"
+	policyAny        = "any"
+	policyBestEffort = "best-effort"
+)
+
+// melpFanoutConfig is a producer that sends each message to several kafka-targets
+type melpFanoutConfig struct {
+	ID       string `json:"id" yaml:"id"`
+	Disabled bool   `json:"disabled" yaml:"disabled"`
+
+	Policy  string                   `json:"policy" yaml:"policy"`
+	Targets []*melpKafkaOutputConfig `json:"targets" yaml:"targets"`
+
+	Idempotency *idempotencyConfig `json:"idempotency" yaml:"idempotency"`
+	RateLimit   *rateLimitConfig   `json:"rateLimit" yaml:"rateLimit"`
+	HeaderRules *headerRules       `json:"headerRules" yaml:"headerRules"`
+
+	MaxBodyBytes  int64 `json:"maxBodyBytes" yaml:"maxBodyBytes"`
+	MaxBatchBytes int64 `json:"maxBatchBytes" yaml:"maxBatchBytes"`
+
+	Auth Auth `json:"auth" yaml:"auth"`
+
+	producer *fanoutProducer
+}
+
+func (config *melpFanoutConfig) Validate() ([]error, bool) {
+	if config.Disabled {
+		return nil, false
+	}
+
+	config.producer = &fanoutProducer{
+		ID:        config.ID,
+		Policy:    config.Policy,
+		Dedup:     config.Idempotency,
+		RateLimit: config.RateLimit,
+		Headers:   config.HeaderRules,
+		Auth:      &config.Auth,
+
+		BodyLimit:  config.MaxBodyBytes,
+		BatchLimit: config.MaxBatchBytes,
+	}
+
+	var errs []error
+	for i, target := range config.Targets {
+		if target.ID == "" {
+			target.ID = fmt.Sprintf("%s-%d", config.ID, i+1)
+		}
+
+		// these are handled by the fan-out, not by each target
+		if target.Auth.Bearer != "" || len(target.Auth.Basic) > 0 || target.Idempotency != nil ||
+			target.RateLimit != nil || target.HeaderRules != nil {
+			errs = append(errs, fmt.Errorf("target #%d: 'auth', 'idempotency', 'rateLimit' and 'headerRules' must be set on the fanout", i))
+		}
+		target.Auth.Anonymous = true
+
+		targetErrs, active := target.Validate()
+		for _, err := range targetErrs {
+			errs = append(errs, fmt.Errorf("target #%d: %w", i, err))
+		}
+		if active {
+			config.producer.Targets = append(config.producer.Targets, target.producer)
+		}
+	}
+
+	producerErrs, _ := config.producer.Validate()
+	return append(errs, producerErrs...), true
+}
+
+func (config *melpFanoutConfig) NewProducer() (Producer, error) {
+	if config.Disabled {
+		return nil, nil
+	}
+
+	log.Info().Msgf("Connecting to '%s'...", config.producer.Name())
+	_, err := config.producer.Connect()
+	if err != nil {
+		// keep the producer, the policy decides if the other targets are enough
+		log.Error().Msgf("%s: unable to connect: %v", config.producer.Name(), err)
+		return config.producer, err
+	}
+	return config.producer, nil
+}
+
+// fanoutProducer sends each message to all targets (in order)
+type fanoutProducer struct {
+	ID      string
+	Policy  string
+	Targets []*kafkaProducer
+
+	Dedup     *idempotencyConfig
+	RateLimit *rateLimitConfig
+	Headers   *headerRules
+
+	BodyLimit  int64
+	BatchLimit int64
+
+	Auth *Auth
+
+	dedup   *idempotencyStore
+	limiter *rateLimiter
+}
+
+func (p *fanoutProducer) Name() string {
+	return p.ID
+}
+
+func (p *fanoutProducer) Validate() ([]error, bool) {
+	var errs []error
+
+	if (p.Auth.Bearer == "") && (len(p.Auth.Basic) == 0) && !p.Auth.Anonymous {
+		errs = append(errs, stringError("'auth' must have either 'anon' or 'bearer/basic'"))
+	}
+
+	if p.ID == "" {
+		errs = append(errs, requiredError(ID))
+	}
+
+	switch p.Policy {
+	case "":
+		p.Policy = policyAll
+	case policyAll, policyAny, policyBestEffort:
+	default:
+		errs = append(errs, invalidError("policy"))
+	}
+
+	if len(p.Targets) == 0 {
+		errs = append(errs, requiredError("targets"))
+	}
+
+	if p.Headers != nil {
+		errs = append(errs, p.Headers.Validate("headerRules")...)
+	}
+
+	// by default the smallest limits of the targets
+	var bodyLimit, batchLimit int64
+	for _, target := range p.Targets {
+		if bodyLimit == 0 || target.BodyLimit < bodyLimit {
+			bodyLimit = target.BodyLimit
+		}
+		if batchLimit == 0 || target.BatchLimit < batchLimit {
+			batchLimit = target.BatchLimit
+		}
+	}
+	if p.BodyLimit == 0 {
+		p.BodyLimit = bodyLimit
+	}
+	if p.BatchLimit == 0 {
+		p.BatchLimit = batchLimit
+	}
+	if p.BodyLimit < 0 {
+		errs = append(errs, invalidError("maxBodyBytes"))
+	}
+	if p.BatchLimit < 0 {
+		errs = append(errs, invalidError("maxBatchBytes"))
+	}
+
+	if p.Dedup != nil {
+		errs = append(errs, p.Dedup.Validate()...)
+	}
+
+	if p.RateLimit != nil {
+		errs = append(errs, p.RateLimit.Validate()...)
+		p.limiter = newRateLimiter(p.ID, p.RateLimit)
+	}
+
+	return errs, true
+}
+
+// Connect all targets, returns the first error (but still tries the rest)
+func (p *fanoutProducer) Connect() (Producer, error) {
+	if p.Dedup != nil && p.dedup == nil {
+		dedup, err := newIdempotencyStore(p.Dedup)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open idempotency-store: %w", err)
+		}
+		p.dedup = dedup
+	}
+
+	var first error
+	for _, target := range p.Targets {
+		if _, err := target.Connect(); err != nil {
+			log.Error().Msgf("%s: unable to connect '%s': %v", p.ID, target.Name(), err)
+			target.Reconnect()
+			if first == nil {
+				first = fmt.Errorf("%s: %w", target.Name(), err)
+			}
+		}
+	}
+	return p, first
+}
+
+func (p *fanoutProducer) Close() error {
+	var first error
+	for _, target := range p.Targets {
+		if err := target.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (p *fanoutProducer) Authorize(r *http.Request) (bool, error) {
+	return p.Auth.Validate(r)
+}
+
+// Identity returns who the (authorized) caller is
+func (p *fanoutProducer) Identity(r *http.Request) string {
+	return p.Auth.Identity(r)
+}
+
+// Idempotency returns the store for requests with an Idempotency-Key (or nil)
+func (p *fanoutProducer) Idempotency() *idempotencyStore {
+	return p.dedup
+}
+
+// HeaderRules returns how headers of a request are passed on (or nil for the defaults)
+func (p *fanoutProducer) HeaderRules() *headerRules {
+	return p.Headers
+}
+
+// Limiter returns the rate-limiter of the producer (or nil)
+func (p *fanoutProducer) Limiter() *rateLimiter {
+	return p.limiter
+}
+
+// MaxBodyBytes is the largest body accepted by '/send'
+func (p *fanoutProducer) MaxBodyBytes() int64 {
+	return p.BodyLimit
+}
+
+// MaxBatchBytes is the largest body accepted by '/send/{id}/batch'
+func (p *fanoutProducer) MaxBatchBytes() int64 {
+	return p.BatchLimit
+}
+
+// Delivery returns the delivery-status of an async message in any of the targets
+func (p *fanoutProducer) Delivery(id string) *deliveryStatus {
+	for _, target := range p.Targets {
+		if status := target.Delivery(id); status != nil {
+			return status
+		}
+	}
+	return nil
+}
+
+// fanoutResult is the result of one target
+type fanoutResult struct {
+	Target string      `json:"target"`
+	Result interface{} `json:"result,omitempty"`
+	Code   string      `json:"code,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type fanoutResponse struct {
+	Policy  string         `json:"policy"`
+	Failed  int            `json:"failed"`
+	Results []fanoutResult `json:"results"`
+
+	status int
+}
+
+func (resp *fanoutResponse) StatusCode() int {
+	return resp.status
+}
+
+// accepted checks the number of successful targets against the policy
+func (p *fanoutProducer) accepted(ok int) bool {
+	switch p.Policy {
+	case policyAny:
+		return ok > 0
+	case policyBestEffort:
+		return true
+	}
+	return ok == len(p.Targets)
+}
+
+func (p *fanoutProducer) Send(msg Message, r *http.Request) (interface{}, error) {
+	response := &fanoutResponse{
+		Policy:  p.Policy,
+		Results: make([]fanoutResult, len(p.Targets)),
+		status:  http.StatusOK,
+	}
+
+	var failure *problem
+	for i, target := range p.Targets {
+		result := &response.Results[i]
+		result.Target = target.Name()
+
+		res, err := target.Send(msg, r)
+		if err != nil {
+			prob := sendProblem(err)
+			log.Warn().Msgf("%s: sending to '%s' failed: %v", p.ID, target.Name(), err)
+			result.Code = prob.Code
+			result.Error = err.Error()
+			response.Failed++
+			if failure == nil {
+				failure = prob
+			}
+			continue
+		}
+		result.Result = res
+	}
+
+	switch {
+	case !p.accepted(len(p.Targets) - response.Failed):
+		response.status = failure.Status
+	case response.Failed > 0:
+		response.status = http.StatusMultiStatus
+	}
+
+	log.AddRequestFields(r, "targets", len(p.Targets), "failed", response.Failed)
+	return response, nil
+}
+
+// targetBatchResult is the result of a message in a batch for one target
+type targetBatchResult struct {
+	Target string `json:"target"`
+	batchResult
+}
+
+// SendBatch sends the batch to all targets, each message gets the results of every target
+func (p *fanoutProducer) SendBatch(msgs []Message, r *http.Request) ([]batchResult, error) {
+	results := make([]batchResult, len(msgs))
+	failed := make([]int, len(msgs))
+
+	for _, target := range p.Targets {
+		batch, err := target.SendBatch(msgs, r)
+		for i := range msgs {
+			res := batchResult{Partition: -1, Offset: -1}
+			switch {
+			case err != nil:
+				res.Code = sendProblem(err).Code
+				res.Error = err.Error()
+			case i < len(batch):
+				res = batch[i]
+			}
+			if res.Error != "" {
+				failed[i]++
+			}
+			results[i].Targets = append(results[i].Targets, targetBatchResult{
+				Target:      target.Name(),
+				batchResult: res,
+			})
+		}
+	}
+
+	for i := range results {
+		results[i].Partition = -1
+		results[i].Offset = -1
+		if !p.accepted(len(p.Targets) - failed[i]) {
+			for _, res := range results[i].Targets {
+				if res.Error != "" {
+					results[i].Code = res.Code
+					results[i].Error = fmt.Sprintf("%s: %s", res.Target, res.Error)
+					break
+				}
+			}
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ninlil/butler/log"
+)
+
+// headerRules decides which headers are passed on, and how
+type headerRules struct {
+	Allow  []string          `json:"allow" yaml:"allow"`
+	Deny   []string          `json:"deny" yaml:"deny"`
+	Rename map[string]string `json:"rename" yaml:"rename"`
+	Set    map[string]string `json:"set" yaml:"set"`
+
+	rename map[string]string
+	set    []headerValue
+}
+
+// headerValue is a header that is set on every message
+type headerValue struct {
+	name string
+	tmpl *messageTemplate
+}
+
+func (hr *headerRules) Validate(name string) []error {
+	var errs []error
+
+	for _, pattern := range append(append([]string{}, hr.Allow...), hr.Deny...) {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s: pattern '%s': %w", name, pattern, err))
+		}
+	}
+
+	// renames are matched on the original (lower-case) key
+	hr.rename = make(map[string]string, len(hr.Rename))
+	for from, to := range hr.Rename {
+		if from == "" || to == "" {
+			errs = append(errs, invalidError(name+".rename"))
+			continue
+		}
+		lower := strings.ToLower(from)
+		if _, ok := hr.rename[lower]; ok {
+			errs = append(errs, fmt.Errorf("%s.rename: '%s' is renamed more than once", name, from))
+		}
+		hr.rename[lower] = http.CanonicalHeaderKey(to)
+	}
+
+	// sorted, so that errors (and the order the headers are set) are stable
+	keys := make([]string, 0, len(hr.Set))
+	for k := range hr.Set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hr.set = nil
+	for _, k := range keys {
+		if k == "" {
+			errs = append(errs, invalidError(name+".set"))
+			continue
+		}
+		tmpl, err := newMessageTemplate(k, hr.Set[k])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.set '%s': %w", name, k, err))
+			continue
+		}
+		hr.set = append(hr.set, headerValue{name: k, tmpl: tmpl})
+	}
+
+	return errs
+}
+
+func matchHeader(patterns []string, key string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Denied is true if the header must not be passed on
+func (hr *headerRules) Denied(key string) bool {
+	return hr != nil && matchHeader(hr.Deny, key)
+}
+
+// Passes is true if the header should be passed on,
+// 'fallback' is used when there is no allow-list
+func (hr *headerRules) Passes(key string, fallback bool) bool {
+	if hr.Denied(key) {
+		return false
+	}
+	if hr == nil || len(hr.Allow) == 0 {
+		return fallback
+	}
+	return matchHeader(hr.Allow, key)
+}
+
+// Transform removes denied headers, renames headers and sets the static ones
+func (hr *headerRules) Transform(msg *Message, mc *messageContext) {
+	if hr == nil {
+		return
+	}
+
+	var hdrs []Header
+	for _, h := range msg.Headers {
+		if !hr.Denied(h.Key) {
+			hdrs = append(hdrs, h)
+		}
+	}
+	msg.Headers = hdrs
+
+	// each header is renamed (at most) once, by its original key, so 'a: b' and 'b: c' don't chain
+	for i, h := range msg.Headers {
+		if to, ok := hr.rename[strings.ToLower(h.Key)]; ok {
+			msg.Headers[i].Key = to
+		}
+	}
+
+	for _, hv := range hr.set {
+		v, err := hv.tmpl.Execute(mc)
+		if err != nil {
+			log.Warn().Msgf("unable to set header '%s': %v", hv.name, err)
+			continue
+		}
+		msg.SetHeader(hv.name, v)
+	}
+}
+
+// isPassthruHeader is true for the headers that are passed on by default
+func isPassthruHeader(key string) bool {
+	for _, h := range passthruHeaders {
+		if strings.EqualFold(h, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// binary header-values are sent over HTTP as '=?binary?b?BASE64?=' (in the style of RFC 2047)
+const (
+	binaryHeaderPrefix = "=?binary?b?"
+	binaryHeaderSuffix = "?="
+)
+
+// encodeHeaderValue returns a value that can be sent as an HTTP-header,
+// anything that isn't printable UTF-8 is base64-encoded with a marker
+func encodeHeaderValue(value []byte) string {
+	if isTextHeader(value) {
+		return string(value)
+	}
+	return binaryHeaderPrefix + base64.StdEncoding.EncodeToString(value) + binaryHeaderSuffix
+}
+
+// decodeHeaderValue reverses encodeHeaderValue
+func decodeHeaderValue(value string) []byte {
+	if strings.HasPrefix(value, binaryHeaderPrefix) && strings.HasSuffix(value, binaryHeaderSuffix) {
+		encoded := value[len(binaryHeaderPrefix) : len(value)-len(binaryHeaderSuffix)]
+		if raw, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			return raw
+		}
+	}
+	return []byte(value)
+}
+
+func isTextHeader(value []byte) bool {
+	if !utf8.Valid(value) || bytes.HasPrefix(value, []byte(binaryHeaderPrefix)) {
+		return false
+	}
+	for _, c := range value {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+
 	"github.com/ninlil/butler/log"
 )
 
@@ -29,3 +32,10 @@ func flag2text(flag bool, trueText, falseText string) string {
 	}
 	return falseText
 }
+
+// newMessageID returns a random id (32 hex-characters)
+func newMessageID() string {
+	var buf [16]byte
+	_, _ = rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninlil/butler/log"
+)
+
+// Machine-readable error-codes for idempotency
+const (
+	codeRequestInProgress = "request-in-progress"
+)
+
+const (
+	defaultIdempotencySize = 10000
+	defaultIdempotencyTTL  = 24 * time.Hour
+
+	idempotencyHeader = "Idempotency-Key"
+)
+
+var errRequestInProgress = stringError("a request with the same Idempotency-Key is in progress")
+
+// idempotencyConfig is the (optional) de-duplication of requests with an 'Idempotency-Key' header
+type idempotencyConfig struct {
+	Size int           `json:"size" yaml:"size"`
+	TTL  time.Duration `json:"ttl" yaml:"ttl"`
+	Dir  string        `json:"dir" yaml:"dir"`
+}
+
+func (cfg *idempotencyConfig) Validate() []error {
+	var errs []error
+
+	if cfg.Size == 0 {
+		cfg.Size = defaultIdempotencySize
+	}
+	if cfg.Size < 0 {
+		errs = append(errs, invalidError("idempotency.size"))
+	}
+
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultIdempotencyTTL
+	}
+	if cfg.TTL < 0 {
+		errs = append(errs, invalidError("idempotency.ttl"))
+	}
+
+	return errs
+}
+
+// storedResponse is the response of the first request with an Idempotency-Key
+type storedResponse struct {
+	Key     string          `json:"key"`
+	Status  int             `json:"status"`
+	Body    json.RawMessage `json:"body"`
+	Expires time.Time       `json:"expires"`
+}
+
+// replayedResponse sends a stored response again
+type replayedResponse struct {
+	stored *storedResponse
+}
+
+func (resp *replayedResponse) StatusCode() int {
+	return resp.stored.Status
+}
+
+// MarshalJSON returns the original body
+func (resp *replayedResponse) MarshalJSON() ([]byte, error) {
+	if len(resp.stored.Body) == 0 {
+		return []byte("null"), nil
+	}
+	return resp.stored.Body, nil
+}
+
+// idempotencyStore remembers the latest responses in memory (and optionally on disk)
+type idempotencyStore struct {
+	cfg *idempotencyConfig
+
+	lock     sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	inFlight map[string]bool
+}
+
+func newIdempotencyStore(cfg *idempotencyConfig) (*idempotencyStore, error) {
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+
+	store := &idempotencyStore{
+		cfg:      cfg,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		inFlight: make(map[string]bool),
+	}
+
+	if cfg.Dir != "" {
+		go store.sweep()
+	}
+
+	return store, nil
+}
+
+// Start a request, returns the stored response if the key has already been used
+func (store *idempotencyStore) Start(key string) (*storedResponse, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.inFlight[key] {
+		return nil, newProblem(http.StatusConflict, codeRequestInProgress, errRequestInProgress)
+	}
+
+	if resp := store.get(key); resp != nil {
+		return resp, nil
+	}
+
+	store.inFlight[key] = true
+	return nil, nil
+}
+
+// Finish a request, successful responses are stored.
+// A '207 Multi-Status' is not stored, so that a repeated request sends the failed messages again.
+func (store *idempotencyStore) Finish(key string, response interface{}, status int) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.inFlight, key)
+
+	if status < 200 || status > 299 || status == http.StatusMultiStatus {
+		return
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Warn().Msgf("unable to store response for Idempotency-Key '%s': %v", key, err)
+		return
+	}
+
+	resp := &storedResponse{
+		Key:     key,
+		Status:  status,
+		Body:    body,
+		Expires: time.Now().Add(store.cfg.TTL),
+	}
+	store.put(resp)
+
+	if store.cfg.Dir != "" {
+		if err := store.write(resp); err != nil {
+			log.Warn().Msgf("unable to store response for Idempotency-Key '%s': %v", key, err)
+		}
+	}
+}
+
+func (store *idempotencyStore) get(key string) *storedResponse {
+	if elem, ok := store.entries[key]; ok {
+		resp := elem.Value.(*storedResponse)
+		if time.Now().Before(resp.Expires) {
+			store.order.MoveToFront(elem)
+			return resp
+		}
+		store.order.Remove(elem)
+		delete(store.entries, key)
+	}
+
+	if store.cfg.Dir == "" {
+		return nil
+	}
+
+	resp, err := store.read(key)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Msgf("unable to read response for Idempotency-Key '%s': %v", key, err)
+		}
+		return nil
+	}
+	if !time.Now().Before(resp.Expires) {
+		_ = os.Remove(store.filename(key))
+		return nil
+	}
+	store.put(resp)
+	return resp
+}
+
+func (store *idempotencyStore) put(resp *storedResponse) {
+	if elem, ok := store.entries[resp.Key]; ok {
+		elem.Value = resp
+		store.order.MoveToFront(elem)
+		return
+	}
+
+	store.entries[resp.Key] = store.order.PushFront(resp)
+	for store.order.Len() > store.cfg.Size {
+		oldest := store.order.Back()
+		store.order.Remove(oldest)
+		delete(store.entries, oldest.Value.(*storedResponse).Key)
+	}
+}
+
+func (store *idempotencyStore) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(store.cfg.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (store *idempotencyStore) write(resp *storedResponse) error {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	name := store.filename(resp.Key)
+	if err := os.WriteFile(name+".tmp", buf, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (store *idempotencyStore) read(key string) (*storedResponse, error) {
+	buf, err := os.ReadFile(store.filename(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp storedResponse
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// sweep removes expired responses from disk (once an hour)
+func (store *idempotencyStore) sweep() {
+	for {
+		entries, err := os.ReadDir(store.cfg.Dir)
+		if err != nil {
+			log.Warn().Msgf("unable to sweep idempotency-store: %v", err)
+		}
+		now := time.Now()
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if now.Sub(info.ModTime()) > store.cfg.TTL {
+				_ = os.Remove(filepath.Join(store.cfg.Dir, entry.Name()))
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// idempotencyKey is the Idempotency-Key of the request, scoped per route and (verified) caller.
+// Anonymous callers share the keys of the route, their address changes when they switch network.
+func idempotencyKey(p Producer, r *http.Request) string {
+	key := r.Header.Get(idempotencyHeader)
+	if key == "" {
+		return ""
+	}
+	caller := p.Identity(r)
+	if strings.HasPrefix(caller, anonymousPrefix) {
+		caller = ""
+	}
+	return strings.Join([]string{p.Name(), caller, r.Method, r.URL.Path, key}, "\n")
+}
+
+// idempotent runs 'handler' only once per Idempotency-Key, repeated calls get the first response
+func idempotent(p Producer, w http.ResponseWriter, r *http.Request, handler func() (interface{}, int, error)) (response interface{}, status int, err error) {
+	store := p.Idempotency()
+	key := idempotencyKey(p, r)
+	if store == nil || key == "" {
+		return handler()
+	}
+
+	stored, err := store.Start(key)
+	if err != nil {
+		return reply(w, err)
+	}
+	if stored != nil {
+		log.Debug().Msgf("%s: repeated Idempotency-Key '%s'", p.Name(), r.Header.Get(idempotencyHeader))
+		log.AddRequestFields(r, "idempotent", true)
+		return reply(w, &replayedResponse{stored: stored})
+	}
+
+	// also when the handler panics, or the key would be 'in progress' forever
+	defer func() {
+		store.Finish(key, response, status)
+	}()
+	return handler()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	request := func(addr string) string {
+		r := httptest.NewRequest("POST", "/send/orders", nil)
+		r.RemoteAddr = addr
+		r.Header.Set(idempotencyHeader, "abc")
+		return idempotencyKey(&kafkaProducer{ID: "orders"}, r)
+	}
+
+	// an anonymous client that switches network is the same caller
+	if request("10.0.0.1:1234") != request("192.168.1.2:5678") {
+		t.Error("anonymous keys differ by address")
+	}
+
+	p := &kafkaProducer{ID: "orders", Auth: &Auth{Bearer: "secret"}}
+	verified := httptest.NewRequest("POST", "/send/orders", nil)
+	verified.Header.Set(idempotencyHeader, "abc")
+	verified.Header.Set("Authorization", "Bearer secret")
+	if idempotencyKey(p, verified) == request("10.0.0.1:1234") {
+		t.Error("a verified caller shares the keys of anonymous callers")
+	}
+}
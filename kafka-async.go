@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ninlil/butler/log"
+)
+
+// Delivery states of an async message
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// how many delivery-statuses that are remembered (per producer)
+const deliveryLimit = 10000
+
+// how many receipts that can be queued before they are dropped
+const receiptQueueSize = 1000
+
+type deliveryStatus struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type kafkaAsyncResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func (resp *kafkaAsyncResponse) StatusCode() int {
+	return http.StatusAccepted
+}
+
+// deliveryTracker remembers the latest delivery-statuses, oldest are forgotten first
+type deliveryTracker struct {
+	lock   sync.Mutex
+	status map[string]*deliveryStatus
+	order  []string
+	next   int
+}
+
+func newDeliveryTracker(limit int) *deliveryTracker {
+	return &deliveryTracker{
+		status: make(map[string]*deliveryStatus, limit),
+		order:  make([]string, limit),
+	}
+}
+
+func (dt *deliveryTracker) Add(status *deliveryStatus) {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+
+	if old := dt.order[dt.next]; old != "" {
+		delete(dt.status, old)
+	}
+	dt.order[dt.next] = status.ID
+	dt.next = (dt.next + 1) % len(dt.order)
+	dt.status[status.ID] = status
+}
+
+func (dt *deliveryTracker) Update(id string, update func(*deliveryStatus)) *deliveryStatus {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+
+	status := dt.status[id]
+	if status == nil {
+		return nil
+	}
+	update(status)
+	result := *status
+	return &result
+}
+
+func (dt *deliveryTracker) Get(id string) *deliveryStatus {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+
+	status := dt.status[id]
+	if status == nil {
+		return nil
+	}
+	result := *status
+	return &result
+}
+
+// handleDeliveries processes the results from the async-producer until it is closed
+func (p *kafkaProducer) handleDeliveries(producer sarama.AsyncProducer) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for pkg := range producer.Successes() {
+			metrics.Send(pkg.Topic, pkg.Partition, valueLength(pkg))
+			p.delivered(pkg, nil)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for perr := range producer.Errors() {
+			log.Error().Msgf("%s: async delivery failed: %v", p.ID, perr.Err)
+			p.delivered(perr.Msg, perr.Err)
+		}
+	}()
+
+	wg.Wait()
+	if p.receipts != nil {
+		close(p.receipts)
+	}
+}
+
+func (p *kafkaProducer) delivered(pkg *sarama.ProducerMessage, err error) {
+	id, ok := pkg.Metadata.(string)
+	if !ok {
+		return
+	}
+
+	status := p.deliveries.Update(id, func(status *deliveryStatus) {
+		status.Partition = pkg.Partition
+		status.Offset = pkg.Offset
+		status.Timestamp = time.Now().UTC()
+		if err != nil {
+			status.Status = deliveryFailed
+			status.Error = err.Error()
+		} else {
+			status.Status = deliveryDelivered
+		}
+	})
+
+	if status == nil || p.receipts == nil {
+		return
+	}
+
+	select {
+	case p.receipts <- status:
+	default:
+		log.Warn().Msgf("%s: receipt-queue is full, dropping receipt for '%s'", p.ID, id)
+	}
+}
+
+// sendReceipts posts delivery-receipts to the receipt-callback
+func (p *kafkaProducer) sendReceipts() {
+	for status := range p.receipts {
+		body, err := json.Marshal(status)
+		if err != nil {
+			log.Error().Msgf("%s: unable to marshal receipt: %v", p.ID, err)
+			continue
+		}
+
+		msg := &Message{Body: body}
+		msg.AddHeader("Content-Type", "application/json")
+		msg.AddMetadata("id", status.ID)
+		msg.AddMetadata("status", status.Status)
+		msg.AddMetadata("topic", status.Topic)
+		msg.AddMetadata("partition", strconv.FormatInt(int64(status.Partition), 10))
+		msg.AddMetadata("offset", strconv.FormatInt(status.Offset, 10))
+
+		if err := p.Receipt.Send(msg); err != nil {
+			log.Error().Msgf("%s: unable to send receipt for '%s': %v", p.ID, status.ID, err)
+		}
+	}
+}
+
+// sendAsync queues the message, returns errNotConnected if the producer is (being) closed
+func (p *kafkaProducer) sendAsync(pkg *sarama.ProducerMessage) (*kafkaAsyncResponse, error) {
+	// the input-channel is closed by 'Close'
+	p.asyncLock.RLock()
+	defer p.asyncLock.RUnlock()
+	if !p.connected.Load() {
+		return nil, errNotConnected
+	}
+
+	id := newMessageID()
+	pkg.Metadata = id
+
+	p.deliveries.Add(&deliveryStatus{
+		ID:        id,
+		Status:    deliveryPending,
+		Topic:     pkg.Topic,
+		Partition: -1,
+		Offset:    -1,
+		Timestamp: time.Now().UTC(),
+	})
+
+	p.async.Input() <- pkg
+
+	return &kafkaAsyncResponse{
+		ID:     id,
+		Status: deliveryPending,
+	}, nil
+}
+
+// Delivery returns the delivery-status of an async message
+func (p *kafkaProducer) Delivery(id string) *deliveryStatus {
+	if p.deliveries == nil {
+		return nil
+	}
+	return p.deliveries.Get(id)
+}
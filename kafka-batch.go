@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ninlil/butler/log"
+)
+
+// Formats of a batched callback
+const (
+	batchFormatJSON   = "json"
+	batchFormatNDJSON = "ndjson"
+)
+
+const (
+	defaultBatchSize   = 100
+	defaultBatchLinger = time.Second
+
+	batchSizeHeader = "Melp-Batch-Size"
+)
+
+var errBatchResults = stringError("the number of results does not match the batch")
+
+// batchConfig sends several messages to the callback in one request
+type batchConfig struct {
+	Size    int           `json:"size" yaml:"size"`
+	Linger  time.Duration `json:"linger" yaml:"linger"`
+	Format  string        `json:"format" yaml:"format"`
+	Results bool          `json:"results" yaml:"results"`
+}
+
+func (cfg *batchConfig) Validate(name string) []error {
+	var errs []error
+
+	if cfg.Size == 0 {
+		cfg.Size = defaultBatchSize
+	}
+	if cfg.Size < 0 {
+		errs = append(errs, invalidError(name+".size"))
+	}
+	if cfg.Linger == 0 {
+		cfg.Linger = defaultBatchLinger
+	}
+	if cfg.Linger < 0 {
+		errs = append(errs, invalidError(name+".linger"))
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = batchFormatJSON
+	case batchFormatJSON, batchFormatNDJSON:
+	default:
+		errs = append(errs, invalidError(name+".format"))
+	}
+
+	return errs
+}
+
+// batchRecord is a message (with its metadata) in a batch
+type batchRecord struct {
+	Topic       string                  `json:"topic"`
+	Partition   int32                   `json:"partition"`
+	Offset      int64                   `json:"offset"`
+	Key         string                  `json:"key,omitempty"`
+	Timestamp   time.Time               `json:"timestamp"`
+	Headers     map[string]headerValues `json:"headers,omitempty"`
+	Value       json.RawMessage         `json:"value,omitempty"`
+	ValueBase64 string                  `json:"valueBase64,omitempty"`
+	Tombstone   bool                    `json:"tombstone,omitempty"`
+	Retry       int                     `json:"retry,omitempty"`
+}
+
+// callbackResult is the result of one message, when the callback responds with 'results'
+type callbackResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func (callback *melpCallback) newBatchRecord(msg *Message) batchRecord {
+	partition, _ := strconv.ParseInt(msg.Metadata["partition"], 10, 32)
+	offset, _ := strconv.ParseInt(msg.Metadata["offset"], 10, 64)
+	retry, _ := strconv.Atoi(msg.Metadata["retry"])
+
+	rec := batchRecord{
+		Topic:     msg.Metadata[TOPIC],
+		Partition: int32(partition),
+		Offset:    offset,
+		Key:       msg.Metadata[PartitionKey],
+		Timestamp: msg.Timestamp,
+		Tombstone: msg.Metadata[TOMBSTONE] != "",
+		Retry:     retry,
+	}
+
+	for _, h := range callback.messageHeaders(msg) {
+		if rec.Headers == nil {
+			rec.Headers = make(map[string]headerValues)
+		}
+		rec.Headers[h.Key] = append(rec.Headers[h.Key], encodeHeaderValue(h.Value))
+	}
+
+	switch {
+	case rec.Tombstone:
+	case json.Valid(msg.Body):
+		rec.Value = msg.Body
+	default:
+		rec.ValueBase64 = base64.StdEncoding.EncodeToString(msg.Body)
+	}
+	return rec
+}
+
+// Encode the records as a JSON-array or as NDJSON
+func (cfg *batchConfig) Encode(records []batchRecord) ([]byte, string, error) {
+	if cfg.Format == batchFormatNDJSON {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for i := range records {
+			if err := enc.Encode(&records[i]); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+
+	data, err := json.Marshal(records)
+	return data, "application/json", err
+}
+
+// SendBatch sends the records in one request, returns the result of each record (if 'results' is used)
+func (callback *melpCallback) SendBatch(cfg *batchConfig, records []batchRecord) ([]callbackResult, error) {
+	body, contentType, err := cfg.Encode(records)
+	if err != nil {
+		return nil, err
+	}
+
+	// all records of a batch are from the same partition
+	vars := map[string]string{
+		TOPIC:       records[0].Topic,
+		"partition": strconv.FormatInt(int64(records[0].Partition), 10),
+	}
+
+	var results []callbackResult
+	var result interface{}
+	if cfg.Results {
+		result = &results
+	}
+	err = callback.post(vars, body, func(hdr http.Header) {
+		hdr.Set("Content-Type", contentType)
+		hdr.Set(batchSizeHeader, strconv.Itoa(len(records)))
+	}, result)
+	if err != nil {
+		return nil, err
+	}
+	// a skipped batch has no results
+	if results != nil && len(results) != len(records) {
+		return nil, errBatchResults
+	}
+	return results, nil
+}
+
+// failedMessage is a message in a batch that could not be processed
+type failedMessage struct {
+	message *sarama.ConsumerMessage
+	err     error
+}
+
+// consumeBatches is ConsumeClaim for a batched callback
+func (r *kafkaReceiver) consumeBatches(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	var batch []*sarama.ConsumerMessage
+	linger := time.NewTimer(r.Batch.Linger)
+	linger.Stop()
+	defer linger.Stop()
+
+	// flush returns false if the batch failed (and the consumer is reconnecting)
+	flush := func() bool {
+		if !linger.Stop() {
+			select {
+			case <-linger.C:
+			default:
+			}
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		ok := r.handleBatch(session, batch)
+		if ok {
+			session.MarkMessage(batch[len(batch)-1], "")
+		}
+		batch = nil
+		return ok
+	}
+
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				flush()
+				return nil
+			}
+			log.Trace().Str("group", r.Group).
+				Str("topic", message.Topic).
+				Int("partition", int(message.Partition)).
+				Msgf("%s: Offset = %d, timestamp = %v", r.ID, message.Offset, message.Timestamp)
+
+			if r.RetryTopics != nil {
+				// don't keep a batch waiting for a message that isn't due yet
+				if r.RetryTopics.Remaining(message) > 0 && !flush() {
+					return nil
+				}
+				if !r.RetryTopics.Wait(session.Context(), message) {
+					return nil
+				}
+			}
+
+			batch = append(batch, message)
+			if len(batch) == 1 {
+				linger.Reset(r.Batch.Linger)
+			}
+			if len(batch) >= r.Batch.Size && !flush() {
+				return nil
+			}
+
+		case <-linger.C:
+			if !flush() {
+				return nil
+			}
+
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// handleBatch sends the messages to the callback, failed messages are retried in the same way as in 'handle'.
+// Returns true when the offsets of the messages can be marked.
+func (r *kafkaReceiver) handleBatch(session sarama.ConsumerGroupSession, messages []*sarama.ConsumerMessage) bool {
+	var attempts int
+	for {
+		attempts++
+		failed := r.processBatch(messages)
+		if len(failed) == 0 {
+			return true
+		}
+
+		for _, f := range failed {
+			log.Error().
+				Str("topic", f.message.Topic).
+				Int32("partition", f.message.Partition).
+				Int64("offset", f.message.Offset).
+				Msgf("processing failed: %v", f.err)
+		}
+
+		if r.DeadLetter == nil {
+			r.Reconnect(failed[0].message.Topic, failed[0].message.Partition, failed[0].message.Offset)
+			return false
+		}
+
+		// only the failed messages are retried
+		messages = nil
+		for _, f := range failed {
+			var ok bool
+			switch {
+			case r.RetryTopics != nil:
+				ok = r.retry(f.message, f.err)
+			case attempts >= r.DeadLetter.cfg.MaxAttempts || isTerminal(f.err):
+				ok = r.deadLetter(f.message, f.err, attempts)
+			default:
+				messages = append(messages, f.message)
+				continue
+			}
+			if !ok {
+				return false
+			}
+		}
+		if len(messages) == 0 {
+			return true
+		}
+
+		select {
+		case <-time.After(reconnectDelay()):
+		case <-session.Context().Done():
+			return false
+		}
+	}
+}
+
+// processBatch sends the messages to the callback, returns the messages that failed
+func (r *kafkaReceiver) processBatch(messages []*sarama.ConsumerMessage) []failedMessage {
+	var failed []failedMessage
+	sent := make([]*sarama.ConsumerMessage, 0, len(messages))
+	records := make([]batchRecord, 0, len(messages))
+
+	start := time.Now()
+	for _, message := range messages {
+		msg := r.CreateMessage(message)
+		if err := r.resolveClaimCheck(msg); err != nil {
+			failed = append(failed, failedMessage{message, err})
+			continue
+		}
+		sent = append(sent, message)
+		records = append(records, r.Callback.newBatchRecord(msg))
+	}
+
+	if len(records) > 0 {
+		results, err := r.Callback.SendBatch(r.Batch, records)
+		log.Trace().Msgf("r.Callback.SendBatch(%d) -> %v", len(records), err)
+		for i, message := range sent {
+			switch {
+			case err != nil:
+				failed = append(failed, failedMessage{message, err})
+			case results != nil:
+				if resErr := r.Callback.resultError(results[i]); resErr != nil {
+					failed = append(failed, failedMessage{message, resErr})
+				}
+			}
+		}
+	}
+
+	dur := time.Since(start)
+	for _, message := range messages {
+		status := "ok"
+		for _, f := range failed {
+			if f.message == message {
+				status = "fail"
+				break
+			}
+		}
+		metrics.Receive(message.Topic, message.Partition, len(message.Value), dur, status)
+	}
+	return failed
+}
+
+// resultError returns the error of a failed result (the same as a failed callback)
+func (callback *melpCallback) resultError(result callbackResult) error {
+	if result.Status >= http.StatusOK && result.Status <= 299 || callback.Retry.IsSkipped(result.Status) {
+		return nil
+	}
+	status := result.Error
+	if status == "" {
+		status = http.StatusText(result.Status)
+	}
+	return &callbackError{
+		StatusCode: result.Status,
+		Status:     fmt.Sprintf("%d %s", result.Status, status),
+		Terminal:   callback.Retry.IsTerminal(result.Status),
+	}
+}
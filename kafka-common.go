@@ -19,10 +19,15 @@ var (
 	TOPICS   = "topics"
 	GROUP    = "group"
 	URL      = "callback.url"
+	MODE     = "mode"
+	RECEIPT  = "receipt.url"
 	//CALLBACK = "callback"
 	//AUTH     = "auth"
 
 	PartitionKey = "partitionkey"
+	PARTITION    = "partition"
+	TOMBSTONE    = "tombstone"
+	TIMESTAMP    = "timestamp"
 
 	errEndpointMissingHost   = stringError("'endpoint' is missing host and/or port")
 	errEndpointInvalidScheme = stringError("'endpoint' is invalid")
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// at most this many times 'concurrency' messages are kept waiting for an earlier offset
+const dispatchWindowFactor = 4
+
+// orderedDispatcher processes the messages of a claim in parallel, but in order for each key.
+// Offsets are only marked when all earlier offsets have been processed.
+type orderedDispatcher struct {
+	session sarama.ConsumerGroupSession
+	handle  func(*sarama.ConsumerMessage) bool
+	slots   chan struct{}
+	window  chan struct{} // the messages in 'pending'
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	keys    map[string]chan struct{} // the last message of each key
+	pending []*pendingOffset         // in offset-order
+}
+
+type pendingOffset struct {
+	message *sarama.ConsumerMessage
+	done    bool
+	ok      bool
+}
+
+func newOrderedDispatcher(session sarama.ConsumerGroupSession, concurrency int, handle func(*sarama.ConsumerMessage) bool) *orderedDispatcher {
+	return &orderedDispatcher{
+		session: session,
+		handle:  handle,
+		slots:   make(chan struct{}, concurrency),
+		window:  make(chan struct{}, concurrency*dispatchWindowFactor),
+		keys:    make(map[string]chan struct{}),
+	}
+}
+
+// Dispatch starts processing of the message (when there is a free slot, and the window of pending offsets isn't full),
+// returns false if the context is done before that
+func (d *orderedDispatcher) Dispatch(ctx context.Context, message *sarama.ConsumerMessage) bool {
+	select {
+	case d.window <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		<-d.window
+		return false
+	}
+
+	p := &pendingOffset{message: message}
+	done := make(chan struct{})
+
+	d.mu.Lock()
+	d.pending = append(d.pending, p)
+	// messages without a key have no order
+	var prev chan struct{}
+	key := string(message.Key)
+	if message.Key != nil {
+		prev = d.keys[key]
+		d.keys[key] = done
+	}
+	d.mu.Unlock()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.slots }()
+
+		if prev != nil {
+			select {
+			case <-prev:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		ok := d.handle(message)
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// a failed message keeps its key blocked until the session ends
+		if ok {
+			close(done)
+			if message.Key != nil && d.keys[key] == done {
+				delete(d.keys, key)
+			}
+		}
+		p.done, p.ok = true, ok
+		d.markCompleted()
+	}()
+	return true
+}
+
+// markCompleted marks the last offset where all earlier offsets are done (called with the lock held)
+func (d *orderedDispatcher) markCompleted() {
+	var last *sarama.ConsumerMessage
+	for len(d.pending) > 0 && d.pending[0].done && d.pending[0].ok {
+		last = d.pending[0].message
+		d.pending = d.pending[1:]
+		<-d.window
+	}
+	if last != nil {
+		d.session.MarkMessage(last, "")
+	}
+}
+
+// Wait for all messages being processed
+func (d *orderedDispatcher) Wait() {
+	d.wg.Wait()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// testSession records the marked offsets
+type testSession struct {
+	ctx context.Context
+
+	lock   sync.Mutex
+	marked int64
+}
+
+func (s *testSession) Claims() map[string][]int32               { return nil }
+func (s *testSession) MemberID() string                         { return "" }
+func (s *testSession) GenerationID() int32                      { return 0 }
+func (s *testSession) MarkOffset(string, int32, int64, string)  {}
+func (s *testSession) Commit()                                  {}
+func (s *testSession) ResetOffset(string, int32, int64, string) {}
+func (s *testSession) Context() context.Context                 { return s.ctx }
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.marked = msg.Offset
+}
+
+func (s *testSession) Marked() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.marked
+}
+
+func TestDispatchWindow(t *testing.T) {
+	const concurrency = 2
+	const count = 100
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &testSession{ctx: ctx, marked: -1}
+
+	// the first message is stuck until 'unblock' is closed
+	unblock := make(chan struct{})
+	d := newOrderedDispatcher(session, concurrency, func(message *sarama.ConsumerMessage) bool {
+		if message.Offset == 0 {
+			<-unblock
+		}
+		return true
+	})
+
+	var dispatched atomic.Int64
+	go func() {
+		for i := 0; i < count; i++ {
+			message := &sarama.ConsumerMessage{Offset: int64(i), Key: []byte(strconv.Itoa(i))}
+			if !d.Dispatch(ctx, message) {
+				return
+			}
+			dispatched.Add(1)
+		}
+	}()
+
+	window := int64(concurrency * dispatchWindowFactor)
+	time.Sleep(100 * time.Millisecond)
+	if n := dispatched.Load(); n != window {
+		t.Errorf("dispatched %d messages behind a stuck offset, want %d", n, window)
+	}
+	d.mu.Lock()
+	pending := len(d.pending)
+	d.mu.Unlock()
+	if pending > int(window) {
+		t.Errorf("%d pending offsets, want at most %d", pending, window)
+	}
+	if marked := session.Marked(); marked != -1 {
+		t.Errorf("offset %d marked before the stuck offset is done", marked)
+	}
+
+	close(unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for dispatched.Load() < count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Wait()
+	if marked := session.Marked(); marked != count-1 {
+		t.Errorf("marked offset %d, want %d", marked, count-1)
+	}
+}
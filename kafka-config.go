@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/ninlil/butler/log"
 )
 
@@ -18,7 +19,29 @@ type melpKafkaOutputConfig struct {
 	ID       string `json:"id" yaml:"id"`
 	Disabled bool   `json:"disabled" yaml:"disabled"`
 
-	Topic string `json:"topic" yaml:"topic"`
+	Topic               string   `json:"topic" yaml:"topic"`
+	AllowedTopics       []string `json:"allowedTopics" yaml:"allowedTopics"`
+	AllowedTopicPattern string   `json:"allowedTopicPattern" yaml:"allowedTopicPattern"`
+
+	Routes []*topicRoute `json:"routes" yaml:"routes"`
+	Key    *keySource    `json:"key" yaml:"key"`
+
+	Timestamp  *timestampConfig  `json:"timestamp" yaml:"timestamp"`
+	ClaimCheck *claimCheckConfig `json:"claimCheck" yaml:"claimCheck"`
+
+	Partitioner string             `json:"partitioner" yaml:"partitioner"`
+	Spool       *spoolConfig       `json:"spool" yaml:"spool"`
+	Idempotency *idempotencyConfig `json:"idempotency" yaml:"idempotency"`
+	RateLimit   *rateLimitConfig   `json:"rateLimit" yaml:"rateLimit"`
+	HeaderRules *headerRules       `json:"headerRules" yaml:"headerRules"`
+
+	MaxBodyBytes  int64 `json:"maxBodyBytes" yaml:"maxBodyBytes"`
+	MaxBatchBytes int64 `json:"maxBatchBytes" yaml:"maxBatchBytes"`
+
+	Mode    string        `json:"mode" yaml:"mode"`
+	Receipt *melpCallback `json:"receipt" yaml:"receipt"`
+
+	Tuning kafkaProducerTuning `json:"tuning" yaml:"tuning"`
 
 	Auth Auth `json:"auth" yaml:"auth"`
 
@@ -30,8 +53,15 @@ type melpKafkaInputConfig struct {
 	ID       string `json:"id" yaml:"id"`
 	Disabled bool   `json:"disabled" yaml:"disabled"`
 
-	Topics []string `json:"topics" yaml:"topics"`
-	Group  string   `json:"group" yaml:"group"`
+	Topics      []string `json:"topics" yaml:"topics"`
+	Group       string   `json:"group" yaml:"group"`
+	Concurrency int      `json:"concurrency" yaml:"concurrency"`
+
+	Batch *batchConfig `json:"batch" yaml:"batch"`
+
+	ClaimCheck  *claimCheckConfig  `json:"claimCheck" yaml:"claimCheck"`
+	DeadLetter  *deadLetterConfig  `json:"deadLetter" yaml:"deadLetter"`
+	RetryTopics *retryTopicsConfig `json:"retryTopics" yaml:"retryTopics"`
 
 	Callback melpCallback `json:"callback" yaml:"callback"`
 
@@ -39,9 +69,13 @@ type melpKafkaInputConfig struct {
 }
 
 type melpCallback struct {
-	URL     string            `json:"url" yaml:"url"`
-	Auth    *Auth             `json:"auth" yaml:"auth"`
-	Headers map[string]string `json:"headers" yaml:"headers"`
+	URL         string            `json:"url" yaml:"url"`
+	Auth        *Auth             `json:"auth" yaml:"auth"`
+	Headers     map[string]string `json:"headers" yaml:"headers"`
+	HeaderRules *headerRules      `json:"headerRules" yaml:"headerRules"`
+	Retry       *retryPolicy      `json:"retry" yaml:"retry"`
+
+	client *retryablehttp.Client
 }
 
 func (config *melpKafkaOutputConfig) Validate() ([]error, bool) {
@@ -59,7 +93,28 @@ func (config *melpKafkaOutputConfig) Validate() ([]error, bool) {
 		ID:       config.ID,
 		Endpoint: newKafkaEndpoint(ep),
 		Topic:    config.Topic,
+		Mode:     config.Mode,
+		Receipt:  config.Receipt,
+		Tuning:   &config.Tuning,
 		Auth:     &config.Auth,
+		Topics: &topicSelector{
+			Allowed: config.AllowedTopics,
+			Pattern: config.AllowedTopicPattern,
+		},
+		Routes: config.Routes,
+		Key:    config.Key,
+
+		Timestamp:  config.Timestamp,
+		ClaimCheck: config.ClaimCheck,
+
+		Partitioner: config.Partitioner,
+		Spool:       config.Spool,
+		Dedup:       config.Idempotency,
+		RateLimit:   config.RateLimit,
+		Headers:     config.HeaderRules,
+
+		BodyLimit:  config.MaxBodyBytes,
+		BatchLimit: config.MaxBatchBytes,
 	}
 
 	return config.producer.Validate()
@@ -77,8 +132,10 @@ func (config *melpKafkaOutputConfig) NewProducer() (Producer, error) {
 	log.Info().Msgf("Connecting to '%s'...", config.producer.Name())
 	_, err := config.producer.Connect()
 	if err != nil {
+		// keep the producer, so that callers get 'unavailable' instead of 'not found' until it is reconnected
 		log.Error().Msgf("%s: unable to connect: %v", config.producer.Name(), err)
-		return nil, err
+		config.producer.Reconnect()
+		return config.producer, err
 	}
 	return config.producer, nil
 }
@@ -99,6 +156,29 @@ func (config *melpKafkaInputConfig) Validate() ([]error, bool) {
 		Topics:   config.Topics,
 		Group:    config.Group,
 		Callback: config.Callback,
+
+		Concurrency: config.Concurrency,
+		Batch:       config.Batch,
+		ClaimCheck:  config.ClaimCheck,
+	}
+
+	if config.DeadLetter != nil {
+		// the same endpoint as the consumer, unless another is set
+		dlEndpoint := ep
+		if config.DeadLetter.Endpoint != "" {
+			dlEndpoint = findKafkaEndpoint(config.DeadLetter.Endpoint)
+		}
+		config.consumer.DeadLetter = &deadLetter{cfg: config.DeadLetter}
+		if dlEndpoint != nil {
+			config.consumer.DeadLetter.endpoint = newKafkaEndpoint(dlEndpoint)
+		}
+	}
+
+	if config.RetryTopics != nil {
+		config.consumer.RetryTopics = &retryTopics{
+			cfg:      config.RetryTopics,
+			endpoint: newKafkaEndpoint(ep),
+		}
 	}
 
 	return config.consumer.Validate()
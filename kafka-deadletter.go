@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"github.com/ninlil/butler/log"
+)
+
+const defaultDeadLetterAttempts = 3
+
+// deadLetterConfig is where messages go when the callback keeps failing
+type deadLetterConfig struct {
+	Endpoint    string `json:"endpoint" yaml:"endpoint"`
+	Topic       string `json:"topic" yaml:"topic"`
+	MaxAttempts int    `json:"maxAttempts" yaml:"maxAttempts"`
+}
+
+// deadLetter sends failed messages (with the reason) to another topic
+type deadLetter struct {
+	cfg      *deadLetterConfig
+	endpoint *kafkaEndpoint
+	producer sarama.SyncProducer
+}
+
+func (dl *deadLetter) Validate() []error {
+	var errs []error
+
+	if dl.endpoint == nil {
+		errs = append(errs, fmt.Errorf("deadLetter: endpoint '%s' not found", dl.cfg.Endpoint))
+	} else if dl.endpoint.err != nil {
+		errs = append(errs, dl.endpoint.err)
+	}
+	if dl.cfg.Topic == "" {
+		errs = append(errs, requiredError("deadLetter.topic"))
+	}
+	if dl.cfg.MaxAttempts == 0 {
+		dl.cfg.MaxAttempts = defaultDeadLetterAttempts
+	}
+	if dl.cfg.MaxAttempts < 0 {
+		errs = append(errs, invalidError("deadLetter.maxAttempts"))
+	}
+
+	return errs
+}
+
+func (dl *deadLetter) Connect(id string) error {
+	if dl.producer != nil {
+		return nil
+	}
+
+	cfg := sarama.NewConfig()
+	cfg.ClientID = fmt.Sprintf("melp-deadletter-%s", id)
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	dl.endpoint.SetConfig(cfg)
+
+	producer, err := sarama.NewSyncProducer(dl.endpoint.Peers(), cfg)
+	if err != nil {
+		return err
+	}
+	dl.producer = producer
+	return nil
+}
+
+func (dl *deadLetter) Close() error {
+	if dl.producer == nil {
+		return nil
+	}
+	err := dl.producer.Close()
+	dl.producer = nil
+	return err
+}
+
+// Send the original record to the dead-letter topic, with headers describing the failure
+func (dl *deadLetter) Send(consumer string, message *sarama.ConsumerMessage, origin recordOrigin, cause error, attempts int) error {
+	if dl.producer == nil {
+		return errNotConnected
+	}
+
+	hdrs := make([]sarama.RecordHeader, 0, len(message.Headers)+7)
+	for _, h := range message.Headers {
+		if h != nil {
+			hdrs = append(hdrs, *h)
+		}
+	}
+	add := func(key, value string) {
+		hdrs = append(hdrs, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	add("Melp-Dlq-Error", cause.Error())
+	var cbErr *callbackError
+	if errors.As(cause, &cbErr) {
+		add("Melp-Dlq-Status", strconv.Itoa(cbErr.StatusCode))
+	}
+	add("Melp-Dlq-Attempts", strconv.Itoa(attempts))
+	add("Melp-Dlq-Consumer", consumer)
+	// where the message was first read from (also when it comes from a retry-topic)
+	add("Melp-Dlq-Topic", origin.Topic)
+	add("Melp-Dlq-Partition", strconv.FormatInt(int64(origin.Partition), 10))
+	add("Melp-Dlq-Offset", strconv.FormatInt(origin.Offset, 10))
+
+	pkg := &sarama.ProducerMessage{
+		Topic:     dl.cfg.Topic,
+		Headers:   hdrs,
+		Timestamp: message.Timestamp,
+	}
+	if message.Key != nil {
+		pkg.Key = sarama.ByteEncoder(message.Key)
+	}
+	if message.Value != nil {
+		pkg.Value = sarama.ByteEncoder(message.Value)
+	}
+
+	partition, offset, err := dl.producer.SendMessage(pkg)
+	if err != nil {
+		return err
+	}
+	log.Warn().
+		Str("topic", message.Topic).
+		Int32("partition", message.Partition).
+		Int64("offset", message.Offset).
+		Msgf("%s: message sent to dead-letter topic '%s' (%d/%d) after %d attempts", consumer, dl.cfg.Topic, partition, offset, attempts)
+	metrics.DeadLetter(consumer, dl.cfg.Topic)
+	return nil
+}
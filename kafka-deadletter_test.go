@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+)
+
+func recordHeaders(pkg *sarama.ProducerMessage) map[string]string {
+	hdrs := make(map[string]string)
+	for _, h := range pkg.Headers {
+		hdrs[string(h.Key)] = string(h.Value)
+	}
+	return hdrs
+}
+
+// a callback without a 'retry' block uses the shared client, the status must still reach the dead-letter topic
+func TestDeadLetterStatusWithoutRetryPolicy(t *testing.T) {
+	waitMin, waitMax := netClient.RetryWaitMin, netClient.RetryWaitMax
+	netClient.RetryWaitMin, netClient.RetryWaitMax = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { netClient.RetryWaitMin, netClient.RetryWaitMax = waitMin, waitMax })
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(pkg *sarama.ProducerMessage) error {
+		hdrs := recordHeaders(pkg)
+		if pkg.Topic != "dlq" {
+			return fmt.Errorf("topic = %s", pkg.Topic)
+		}
+		if hdrs["Melp-Dlq-Status"] != "503" {
+			return fmt.Errorf("Melp-Dlq-Status = '%s', headers: %v", hdrs["Melp-Dlq-Status"], hdrs)
+		}
+		if hdrs["Melp-Dlq-Topic"] != "orders" || hdrs["Melp-Dlq-Offset"] != "5" {
+			return fmt.Errorf("wrong origin, headers: %v", hdrs)
+		}
+		return nil
+	})
+
+	r := &kafkaReceiver{
+		ID:       "orders-consumer",
+		Callback: melpCallback{URL: srv.URL},
+		DeadLetter: &deadLetter{
+			cfg:      &deadLetterConfig{Topic: "dlq", MaxAttempts: 1},
+			producer: producer,
+		},
+	}
+	session := &testSession{ctx: context.Background()}
+	message := &sarama.ConsumerMessage{Topic: "orders", Partition: 2, Offset: 5, Value: []byte("{}")}
+
+	if !r.handle(session, message) {
+		t.Fatal("handle = false, the message should be dead-lettered")
+	}
+	if n := calls.Load(); n != int32(netClient.RetryMax+1) {
+		t.Errorf("callback called %d times, want %d", n, netClient.RetryMax+1)
+	}
+	if err := producer.Close(); err != nil {
+		t.Error(err)
+	}
+}
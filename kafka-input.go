@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -16,8 +17,9 @@ import (
 )
 
 type kafkaReceiver struct {
-	client    sarama.ConsumerGroup
-	connected bool
+	client       sarama.ConsumerGroup
+	connected    bool
+	reconnecting atomic.Bool
 
 	ID       string
 	Endpoint *kafkaEndpoint
@@ -25,6 +27,13 @@ type kafkaReceiver struct {
 	Group    string
 	Callback melpCallback
 
+	Concurrency int
+	Batch       *batchConfig
+
+	ClaimCheck  *claimCheckConfig
+	DeadLetter  *deadLetter
+	RetryTopics *retryTopics
+
 	ready  chan bool
 	ctx    context.Context
 	cancel func()
@@ -60,6 +69,30 @@ func (r *kafkaReceiver) Validate() ([]error, bool) {
 		r.Callback.Auth.Anonymous = (r.Callback.Auth.Bearer == "") && (len(r.Callback.Auth.Basic) == 0)
 	}
 
+	if r.ClaimCheck != nil {
+		errs = append(errs, r.ClaimCheck.Validate("claimCheck")...)
+	}
+
+	if r.DeadLetter != nil {
+		errs = append(errs, r.DeadLetter.Validate()...)
+	}
+
+	if r.RetryTopics != nil {
+		if r.DeadLetter == nil {
+			errs = append(errs, stringError("'retryTopics' requires 'deadLetter'"))
+		}
+		errs = append(errs, r.RetryTopics.Validate()...)
+	}
+
+	if r.Callback.HeaderRules != nil {
+		errs = append(errs, r.Callback.HeaderRules.Validate("callback.headerRules")...)
+	}
+
+	if r.Callback.Retry != nil {
+		errs = append(errs, r.Callback.Retry.Validate("callback.retry")...)
+		r.Callback.client = r.Callback.Retry.NewClient()
+	}
+
 	if r.Endpoint.err != nil {
 		errs = append(errs, r.Endpoint.err)
 	}
@@ -72,6 +105,20 @@ func (r *kafkaReceiver) Validate() ([]error, bool) {
 		errs = append(errs, requiredError(ID))
 	}
 
+	if r.Concurrency == 0 {
+		r.Concurrency = 1
+	}
+	if r.Concurrency < 0 {
+		errs = append(errs, invalidError("concurrency"))
+	}
+
+	if r.Batch != nil {
+		if r.Concurrency > 1 {
+			errs = append(errs, stringError("'batch' can't be used with 'concurrency'"))
+		}
+		errs = append(errs, r.Batch.Validate("batch")...)
+	}
+
 	if r.Group == "" {
 		errs = append(errs, requiredError(GROUP))
 	}
@@ -98,7 +145,24 @@ func (r *kafkaReceiver) Close() error {
 	log.Trace().Msgf("Closing listener '%s'...", r.ID)
 	r.cancel()
 	r.connected = false
-	return nil
+	var err error
+	if r.RetryTopics != nil {
+		err = r.RetryTopics.Close()
+	}
+	if r.DeadLetter != nil {
+		if dlErr := r.DeadLetter.Close(); dlErr != nil {
+			err = dlErr
+		}
+	}
+	return err
+}
+
+// topics returns the topics to consume, including the retry-topics (if any)
+func (r *kafkaReceiver) topics() []string {
+	if r.RetryTopics == nil {
+		return r.Topics
+	}
+	return append(append([]string{}, r.Topics...), r.RetryTopics.Topics(r.Topics)...)
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim.
@@ -125,6 +189,16 @@ func (r *kafkaReceiver) ConsumeClaim(session sarama.ConsumerGroupSession, claim
 	// Do not move the code below to a goroutine.
 	// The `ConsumeClaim` itself is called within a goroutine, see:
 	// https://github.com/IBM/sarama/blob/main/consumer_group.go#L27-L29
+	if r.Batch != nil {
+		return r.consumeBatches(session, claim)
+	}
+	var dispatcher *orderedDispatcher
+	if r.Concurrency > 1 {
+		dispatcher = newOrderedDispatcher(session, r.Concurrency, func(message *sarama.ConsumerMessage) bool {
+			return r.handle(session, message)
+		})
+		defer dispatcher.Wait()
+	}
 	for {
 		select {
 		case message := <-claim.Messages():
@@ -136,25 +210,14 @@ func (r *kafkaReceiver) ConsumeClaim(session sarama.ConsumerGroupSession, claim
 					Int("partition", int(message.Partition)).
 					Msgf("%s: Offset = %d, timestamp = %v", r.ID, message.Offset, message.Timestamp)
 
-				msg := r.CreateMessage(message)
-				start := time.Now()
-				err := r.Callback.Send(msg)
-				dur := time.Since(start)
-				if err == nil {
-					metrics.Receive(message.Topic, message.Partition, len(message.Value), dur, "ok")
-				} else {
-					metrics.Receive(message.Topic, message.Partition, len(message.Value), dur, "fail")
-				}
-				log.Trace().Msgf("r.Callback.Send(msg) -> %v", err)
-				if err != nil {
-					log.Error().
-						Str("topic", message.Topic).
-						Int32("partition", message.Partition).
-						Int64("offset", message.Offset).
-						Msgf("processing failed: %v", err)
-					r.Reconnect(message.Topic, message.Partition, message.Offset)
-				} else {
+				if dispatcher != nil {
+					dispatcher.Dispatch(session.Context(), message)
+				} else if r.handle(session, message) {
 					session.MarkMessage(message, "")
+				} else {
+					// the message was neither processed nor dead-lettered (and the consumer is reconnecting),
+					// so no later offset may be marked
+					return nil
 				}
 			}
 
@@ -167,25 +230,137 @@ func (r *kafkaReceiver) ConsumeClaim(session sarama.ConsumerGroupSession, claim
 	}
 }
 
+// handle processes a message, if it fails it is retried (by reconnecting or via the retry-topics)
+// or sent to the dead-letter topic when all attempts have failed.
+// Returns true when the offset of the message can be marked.
+func (r *kafkaReceiver) handle(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) bool {
+	if r.RetryTopics != nil && !r.RetryTopics.Wait(session.Context(), message) {
+		return false
+	}
+
+	var err error
+	var attempts int
+	for {
+		attempts++
+		err = r.process(message)
+		if err == nil {
+			return true
+		}
+
+		log.Error().
+			Str("topic", message.Topic).
+			Int32("partition", message.Partition).
+			Int64("offset", message.Offset).
+			Msgf("processing failed: %v", err)
+
+		if r.DeadLetter == nil {
+			r.Reconnect(message.Topic, message.Partition, message.Offset)
+			return false
+		}
+		if r.RetryTopics != nil {
+			return r.retry(message, err)
+		}
+		if attempts >= r.DeadLetter.cfg.MaxAttempts || isTerminal(err) {
+			break
+		}
+
+		select {
+		case <-time.After(reconnectDelay()):
+		case <-session.Context().Done():
+			return false
+		}
+	}
+
+	return r.deadLetter(message, err, attempts)
+}
+
+// retry sends a failed message to the next retry-topic, or to the dead-letter topic after the last one
+func (r *kafkaReceiver) retry(message *sarama.ConsumerMessage, cause error) bool {
+	if !isTerminal(cause) {
+		sent, err := r.RetryTopics.Send(r.ID, message, cause)
+		if err != nil {
+			log.Error().Msgf("%s: unable to send to retry-topic: %v", r.ID, err)
+			r.Reconnect(message.Topic, message.Partition, message.Offset)
+			return false
+		}
+		if sent {
+			return true
+		}
+	}
+	return r.deadLetter(message, cause, r.RetryTopics.Tier(message)+1)
+}
+
+func (r *kafkaReceiver) deadLetter(message *sarama.ConsumerMessage, cause error, attempts int) bool {
+	if err := r.DeadLetter.Send(r.ID, message, r.RetryTopics.Origin(message), cause, attempts); err != nil {
+		log.Error().Msgf("%s: unable to send to dead-letter topic: %v", r.ID, err)
+		r.Reconnect(message.Topic, message.Partition, message.Offset)
+		return false
+	}
+	return true
+}
+
+// isTerminal is true when the callback responded with a status that will never succeed
+func isTerminal(err error) bool {
+	var cbErr *callbackError
+	return errors.As(err, &cbErr) && cbErr.Terminal
+}
+
+// process sends a message to the callback
+func (r *kafkaReceiver) process(message *sarama.ConsumerMessage) error {
+	msg := r.CreateMessage(message)
+	start := time.Now()
+	err := r.resolveClaimCheck(msg)
+	if err == nil {
+		err = r.Callback.Send(msg)
+	}
+	dur := time.Since(start)
+	if err == nil {
+		metrics.Receive(message.Topic, message.Partition, len(message.Value), dur, "ok")
+	} else {
+		metrics.Receive(message.Topic, message.Partition, len(message.Value), dur, "fail")
+	}
+	log.Trace().Msgf("r.Callback.Send(msg) -> %v", err)
+	return err
+}
+
 func (r *kafkaReceiver) CreateMessage(message *sarama.ConsumerMessage) *Message {
 	var msg = &Message{
 		Body:      message.Value,
 		Timestamp: message.Timestamp,
 	}
-	msg.AddMetadata("topic", message.Topic)
-	msg.AddMetadata("partition", strconv.FormatInt(int64(message.Partition), 10))
-	msg.AddMetadata("offset", strconv.FormatInt(message.Offset, 10))
+	// a message from a retry-topic keeps the topic, partition and offset it was first read from
+	origin := r.RetryTopics.Origin(message)
+	msg.AddMetadata("topic", origin.Topic)
+	msg.AddMetadata("partition", strconv.FormatInt(int64(origin.Partition), 10))
+	msg.AddMetadata("offset", strconv.FormatInt(origin.Offset, 10))
+	if tier := r.RetryTopics.Tier(message); tier > 0 {
+		msg.AddMetadata("retry", strconv.Itoa(tier))
+	}
 	if len(message.Key) > 0 {
 		msg.AddMetadata(PartitionKey, string(message.Key))
 	}
+	if message.Value == nil {
+		msg.AddMetadata(TOMBSTONE, "true")
+	}
 
 	for _, h := range message.Headers {
-		msg.AddHeader(string(h.Key), string(h.Value))
+		msg.AddRawHeader(string(h.Key), h.Value)
 	}
 
 	return msg
 }
 
+// resolveClaimCheck fetches the payload of a claim-check message (if configured)
+func (r *kafkaReceiver) resolveClaimCheck(msg *Message) error {
+	if r.ClaimCheck == nil {
+		return nil
+	}
+	if err := r.ClaimCheck.Resolve(msg); err != nil {
+		return fmt.Errorf("unable to resolve claim-check: %w", err)
+	}
+	return nil
+}
+
 func (r *kafkaReceiver) Connect() (Consumer, error) {
 
 	//sarama.Logger = stdlog.New(os.Stdout, "sarama", 0)
@@ -201,6 +376,17 @@ func (r *kafkaReceiver) Connect() (Consumer, error) {
 
 	r.Endpoint.SetConfig(cfg)
 
+	if r.DeadLetter != nil {
+		if err := r.DeadLetter.Connect(r.ID); err != nil {
+			return nil, fmt.Errorf("unable to connect dead-letter producer: %w", err)
+		}
+	}
+	if r.RetryTopics != nil {
+		if err := r.RetryTopics.Connect(r.ID, r.Topics); err != nil {
+			return nil, fmt.Errorf("unable to connect retry producer: %w", err)
+		}
+	}
+
 	client, err := sarama.NewConsumerGroup(r.Endpoint.Peers(), r.Group, cfg)
 	if err != nil {
 		return nil, err
@@ -222,8 +408,13 @@ func reconnectDelay() time.Duration {
 }
 
 func (r *kafkaReceiver) Reconnect(topic string, partition int32, offset int64) {
+	// with 'concurrency' several messages can fail at the same time
+	if !r.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
 	log.Warn().Msgf("Kafka(%s): Attempting reconnect..", r.ID)
 	go func() {
+		defer r.reconnecting.Store(false)
 		r.client.Close()
 		delay := reconnectDelay()
 		log.Trace().Msgf("RETRY - Closed... sleeping %v...", delay)
@@ -253,7 +444,7 @@ func (r *kafkaReceiver) Listen(wg *sync.WaitGroup) {
 			// `Consume` should be called inside an infinite loop, when a
 			// server-side rebalance happens, the consumer session will need to be
 			// recreated to get the new claims
-			if err := r.client.Consume(ctx, r.Topics, r); err != nil {
+			if err := r.client.Consume(ctx, r.topics(), r); err != nil {
 				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
 					log.Warn().Msg("Kafka-Listen-error: Consumer-Group was closed")
 					return
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Machine-readable error-codes for key-extraction
+const (
+	codeKeyRequired = "key-required"
+)
+
+var (
+	errKeyRequired  = stringError("a partition-key is required")
+	errTombstoneKey = stringError("a tombstone requires a partition-key")
+)
+
+// keySource is where the partition-key is taken from,
+// if no 'Melp-PartitionKey' header is set
+type keySource struct {
+	Query    string `json:"query" yaml:"query"`
+	Pointer  string `json:"pointer" yaml:"pointer"`
+	Template string `json:"template" yaml:"template"`
+	Required bool   `json:"required" yaml:"required"`
+
+	template *messageTemplate
+}
+
+func (ks *keySource) Validate() []error {
+	var errs []error
+
+	var count int
+	for _, set := range []bool{ks.Query != "", ks.Pointer != "", ks.Template != ""} {
+		if set {
+			count++
+		}
+	}
+	if count > 1 {
+		errs = append(errs, stringError("'key' can only have one of 'query', 'pointer' or 'template'"))
+	}
+
+	if ks.Template != "" {
+		tmpl, err := newMessageTemplate("key", ks.Template)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("'key.template' is invalid: %v", err))
+		}
+		ks.template = tmpl
+	}
+
+	return errs
+}
+
+// Extract the partition-key from the message (or request)
+func (ks *keySource) Extract(msg *Message, r *http.Request) (string, error) {
+	var key string
+
+	mc := newMessageContext(msg, r)
+	switch {
+	case ks.Query != "":
+		key = mc.Query(ks.Query)
+	case ks.Pointer != "":
+		key, _ = mc.Field(ks.Pointer)
+	case ks.template != nil:
+		text, err := ks.template.Execute(mc)
+		if err == nil {
+			key = text
+		}
+	}
+
+	if key == "" && ks.Required {
+		return "", newProblem(http.StatusBadRequest, codeKeyRequired, errKeyRequired)
+	}
+	return key, nil
+}
@@ -1,24 +1,68 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/ninlil/butler/log"
 )
 
+// Producer modes
+const (
+	modeSync  = "sync"
+	modeAsync = "async"
+
+	// the same as the default 'max.message.bytes' of the Kafka-client
+	defaultMaxBodyBytes = 1000000
+	// a batch can be this many times larger than a single message
+	batchBodyFactor = 10
+)
+
 type kafkaProducer struct {
-	msg       sarama.SyncProducer
-	connected bool
+	msg          sarama.SyncProducer
+	async        sarama.AsyncProducer
+	connected    atomic.Bool
+	closed       atomic.Bool
+	reconnecting atomic.Bool
+	asyncLock    sync.RWMutex
 
 	ID       string
 	Topic    string
 	Endpoint *kafkaEndpoint
+	Mode     string
+	Receipt  *melpCallback
+	Tuning   *kafkaProducerTuning
+	Topics   *topicSelector
+	Routes   []*topicRoute
+	Key      *keySource
+
+	Timestamp  *timestampConfig
+	ClaimCheck *claimCheckConfig
+
+	Partitioner string
+	Spool       *spoolConfig
+	Dedup       *idempotencyConfig
+	RateLimit   *rateLimitConfig
+	Headers     *headerRules
+
+	BodyLimit  int64
+	BatchLimit int64
 
 	Auth *Auth
+
+	deliveries *deliveryTracker
+	receipts   chan *deliveryStatus
+	spool      *kafkaSpool
+	dedup      *idempotencyStore
+	limiter    *rateLimiter
+
+	txnLock sync.Mutex
 }
 
 func (p *kafkaProducer) Name() string {
@@ -43,42 +87,235 @@ func (p *kafkaProducer) Validate() ([]error, bool) {
 		errs = append(errs, requiredError(TOPIC))
 	}
 
+	errs = append(errs, p.Topics.Validate()...)
+	for i, route := range p.Routes {
+		errs = append(errs, route.Validate(i)...)
+	}
+	if p.Key != nil {
+		errs = append(errs, p.Key.Validate()...)
+	}
+	if p.Timestamp != nil {
+		errs = append(errs, p.Timestamp.Validate()...)
+	}
+	if p.ClaimCheck != nil {
+		errs = append(errs, p.ClaimCheck.Validate("claimCheck")...)
+		if err := p.ClaimCheck.ValidatePrefix(p.ID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	partitioner, err := validatePartitioner(p.Partitioner)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	p.Partitioner = partitioner
+	errs = append(errs, p.Tuning.Validate()...)
+
+	if p.BodyLimit == 0 {
+		p.BodyLimit = defaultMaxBodyBytes
+		if p.Tuning.MaxMessageBytes > 0 {
+			p.BodyLimit = int64(p.Tuning.MaxMessageBytes)
+		}
+		if p.ClaimCheck != nil {
+			p.BodyLimit = defaultClaimMaxBodyBytes
+		}
+	}
+	if p.BodyLimit < 0 {
+		errs = append(errs, invalidError("maxBodyBytes"))
+	}
+	if p.BatchLimit == 0 {
+		p.BatchLimit = p.BodyLimit * batchBodyFactor
+	}
+	if p.BatchLimit < 0 {
+		errs = append(errs, invalidError("maxBatchBytes"))
+	}
+
+	switch p.Mode {
+	case "":
+		p.Mode = modeSync
+	case modeSync, modeAsync:
+	default:
+		errs = append(errs, invalidError(MODE))
+	}
+
+	if p.Mode == modeAsync && p.Tuning.Transactional() {
+		errs = append(errs, stringError("'tuning.transactionalId' can't be used with 'mode: async'"))
+	}
+
+	if p.Receipt != nil {
+		if p.Mode != modeAsync {
+			errs = append(errs, stringError("'receipt' requires 'mode: async'"))
+		}
+		if p.Receipt.URL == "" {
+			errs = append(errs, requiredError(RECEIPT))
+		}
+		if p.Receipt.Auth != nil {
+			if p.Receipt.Auth.Bearer != "" && len(p.Receipt.Auth.Basic) > 0 {
+				errs = append(errs, fmt.Errorf("can't use both 'bearer' and 'basic' auth"))
+			}
+			p.Receipt.Auth.Anonymous = (p.Receipt.Auth.Bearer == "") && (len(p.Receipt.Auth.Basic) == 0)
+		}
+	}
+
+	if p.Receipt != nil && p.Receipt.HeaderRules != nil {
+		errs = append(errs, p.Receipt.HeaderRules.Validate("receipt.headerRules")...)
+	}
+
+	if p.Receipt != nil && p.Receipt.Retry != nil {
+		errs = append(errs, p.Receipt.Retry.Validate("receipt.retry")...)
+		p.Receipt.client = p.Receipt.Retry.NewClient()
+	}
+
+	if p.Headers != nil {
+		errs = append(errs, p.Headers.Validate("headerRules")...)
+	}
+
+	if p.Dedup != nil {
+		errs = append(errs, p.Dedup.Validate()...)
+	}
+
+	if p.RateLimit != nil {
+		errs = append(errs, p.RateLimit.Validate()...)
+		p.limiter = newRateLimiter(p.ID, p.RateLimit)
+	}
+
+	if p.Spool != nil {
+		errs = append(errs, p.Spool.Validate()...)
+		if p.Mode == modeAsync {
+			errs = append(errs, stringError("'spool' can't be used with 'mode: async'"))
+		}
+		if p.Tuning.Transactional() {
+			errs = append(errs, stringError("'spool' can't be used with 'tuning.transactionalId'"))
+		}
+	}
+
 	return errs, true
 }
 
 // Connect to a Kafka server
 func (p *kafkaProducer) Connect() (Producer, error) {
 
+	if p.Spool != nil && p.spool == nil {
+		spool, err := openSpool(p.ID, p.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open spool: %w", err)
+		}
+		p.spool = spool
+		go p.replaySpool()
+	}
+
+	if p.Dedup != nil && p.dedup == nil {
+		dedup, err := newIdempotencyStore(p.Dedup)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open idempotency-store: %w", err)
+		}
+		p.dedup = dedup
+	}
+
 	log.Info().Msgf("%s: connecting...", p.ID)
 
 	cfg := sarama.NewConfig()
 	cfg.ClientID = fmt.Sprintf("melp-sender-%s", p.ID)
-	cfg.Producer.RequiredAcks = sarama.WaitForLocal
-	cfg.Producer.Retry.Max = 10
 	cfg.Producer.Return.Successes = true
-	cfg.Producer.Compression = sarama.CompressionSnappy
-	//cfg.Producer.Flush.Frequency = 500 * time.Millisecond
+	cfg.Producer.Partitioner = newPartitioner(p.Partitioner)
+	p.Tuning.Apply(cfg)
 
 	p.Endpoint.SetConfig(cfg)
 
 	var list = p.Endpoint.Peers()
 
+	if p.Mode == modeAsync {
+		cfg.Producer.Return.Errors = true
+
+		producer, err := sarama.NewAsyncProducer(list, cfg)
+		if err != nil {
+			return nil, err
+		}
+		p.async = producer
+		p.deliveries = newDeliveryTracker(deliveryLimit)
+		if p.Receipt != nil {
+			p.receipts = make(chan *deliveryStatus, receiptQueueSize)
+			go p.sendReceipts()
+		}
+		go p.handleDeliveries(producer)
+
+		p.connected.Store(true)
+		return p, nil
+	}
+
 	producer, err := sarama.NewSyncProducer(list, cfg)
 	if err != nil {
 		return nil, err
 	}
 	p.msg = producer
+	p.connected.Store(true)
 
 	return p, nil
 }
 
+// Reconnect in the background until connected (or closed), with a spool this is done by 'replaySpool'
+func (p *kafkaProducer) Reconnect() {
+	if p.spool != nil || !p.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.reconnecting.Store(false)
+		for !p.closed.Load() && !p.connected.Load() {
+			time.Sleep(reconnectDelay())
+			if _, err := p.Connect(); err != nil {
+				log.Warn().Msgf("%s: unable to reconnect: %v", p.ID, err)
+				continue
+			}
+			log.Info().Msgf("%s: reconnected", p.ID)
+			// closed while connecting
+			if p.closed.Load() {
+				_ = p.Close()
+			}
+		}
+	}()
+}
+
+// Idempotency returns the store for requests with an Idempotency-Key (or nil)
+func (p *kafkaProducer) Idempotency() *idempotencyStore {
+	return p.dedup
+}
+
+// HeaderRules returns how headers of a request are passed on (or nil for the defaults)
+func (p *kafkaProducer) HeaderRules() *headerRules {
+	return p.Headers
+}
+
+// Limiter returns the rate-limiter of the producer (or nil)
+func (p *kafkaProducer) Limiter() *rateLimiter {
+	return p.limiter
+}
+
+// MaxBodyBytes is the largest body accepted by '/send'
+func (p *kafkaProducer) MaxBodyBytes() int64 {
+	return p.BodyLimit
+}
+
+// MaxBatchBytes is the largest body accepted by '/send/{id}/batch'
+func (p *kafkaProducer) MaxBatchBytes() int64 {
+	return p.BatchLimit
+}
+
 func (p *kafkaProducer) Close() error {
-	if !p.connected {
+	p.closed.Store(true)
+	if !p.connected.Load() {
 		return nil
 	}
-	err := p.msg.Close()
-	p.connected = false
-	return err
+	if p.async != nil {
+		// wait for messages being queued by 'sendAsync'
+		p.asyncLock.Lock()
+		defer p.asyncLock.Unlock()
+		if !p.connected.Swap(false) {
+			return nil
+		}
+		return p.async.Close()
+	}
+	p.connected.Store(false)
+	return p.msg.Close()
 }
 
 func (p *kafkaProducer) Authorize(r *http.Request) (bool, error) {
@@ -88,42 +325,136 @@ func (p *kafkaProducer) Authorize(r *http.Request) (bool, error) {
 	return p.Auth.Validate(r)
 }
 
+// Identity returns who the (authorized) caller is
+func (p *kafkaProducer) Identity(r *http.Request) string {
+	if p.Auth == nil {
+		return Auth{}.Identity(r)
+	}
+	return p.Auth.Identity(r)
+}
+
 type kafkaSendResponse struct {
 	Partition int32 `json:"partition"`
 	Offset    int64 `json:"offset"`
 }
 
-func (p *kafkaProducer) Send(msg Message, r *http.Request) (interface{}, error) {
+func (p *kafkaProducer) newProducerMessage(msg Message, r *http.Request) (*sarama.ProducerMessage, error) {
+	topic, err := p.selectTopic(&msg, r)
+	if err != nil {
+		return nil, err
+	}
+
 	var hdrs = make([]sarama.RecordHeader, 0, len(msg.Headers))
 	var key sarama.Encoder = nil
 
-	for k, v := range msg.Headers {
-		if strings.EqualFold(k, PartitionKey) {
-			key = sarama.StringEncoder(v)
-		} else {
+	for _, h := range msg.Headers {
+		switch {
+		case strings.EqualFold(h.Key, PartitionKey):
+			// an empty key is the same as no key
+			if len(h.Value) > 0 {
+				key = sarama.ByteEncoder(h.Value)
+			}
+		case strings.EqualFold(h.Key, claimCheckHeader):
+			// only set by the producer itself
+		case isRetryHeader(h.Key):
+			// only set by a consumer on the records of a retry-topic
+		default:
 			hdrs = append(hdrs, sarama.RecordHeader{
-				Key:   []byte(k),
-				Value: []byte(v),
+				Key:   []byte(h.Key),
+				Value: h.Value,
 			})
 		}
 	}
 
-	var pkg = sarama.ProducerMessage{
-		Topic:     p.Topic,
+	if key == nil && msg.Metadata[PartitionKey] != "" {
+		key = sarama.StringEncoder(msg.Metadata[PartitionKey])
+	}
+
+	if key == nil && p.Key != nil {
+		text, err := p.Key.Extract(&msg, r)
+		if err != nil {
+			return nil, err
+		}
+		if text != "" {
+			key = sarama.StringEncoder(text)
+		}
+	}
+
+	// a tombstone (null-value) deletes the key in a compacted topic
+	var value sarama.Encoder = sarama.ByteEncoder(msg.Body)
+	if msg.Metadata[TOMBSTONE] != "" {
+		if key == nil {
+			return nil, newProblem(http.StatusBadRequest, codeKeyRequired, errTombstoneKey)
+		}
+		value = nil
+	}
+
+	partition, err := p.selectPartition(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := p.selectTimestamp(&msg, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// after everything else, since topic, key and timestamp can be taken from the body
+	claim, err := p.claimCheck(&msg)
+	if err != nil {
+		return nil, err
+	}
+	if claim != "" {
+		hdrs = append(hdrs, sarama.RecordHeader{Key: []byte(claimCheckHeader), Value: []byte(claim)})
+		value = sarama.ByteEncoder(msg.Body)
+	}
+
+	return &sarama.ProducerMessage{
+		Topic:     topic,
 		Headers:   hdrs,
-		Timestamp: time.Now().UTC(),
+		Timestamp: timestamp,
 		Key:       key,
-		Value:     sarama.ByteEncoder(msg.Body),
+		Value:     value,
+		Partition: partition,
+	}, nil
+}
+
+func (p *kafkaProducer) Send(msg Message, r *http.Request) (interface{}, error) {
+	if !p.connected.Load() && p.spool == nil {
+		return nil, errNotConnected
 	}
 
-	partition, offset, err := p.msg.SendMessage(&pkg)
+	pkg, err := p.newProducerMessage(msg, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.async != nil {
+		response, err := p.sendAsync(pkg)
+		if err != nil {
+			return nil, err
+		}
+		log.AddRequestFields(r, "id", response.ID)
+		return response, nil
+	}
+
+	if p.shouldSpool() {
+		return p.spoolMessage(pkg, pkg.Partition)
+	}
+
+	requested := pkg.Partition
+	partition, offset, err := p.sendMessage(pkg)
 
 	if err != nil {
+		if p.canSpool(err) {
+			log.Warn().Msgf("%s: broker unavailable, spooling message: %v", p.ID, err)
+			return p.spoolMessage(pkg, requested)
+		}
 		return nil, err
 	}
 	log.Trace().Msgf("%s: msg sent: %d/%d", p.ID, partition, offset)
 
-	metrics.Send(p.Topic, partition, len(msg.Body))
+	metrics.Send(pkg.Topic, partition, len(msg.Body))
 
 	log.AddRequestFields(r, "partition", partition, "offset", offset)
 
@@ -132,3 +463,159 @@ func (p *kafkaProducer) Send(msg Message, r *http.Request) (interface{}, error)
 		Offset:    offset,
 	}, nil
 }
+
+// SendBatch sends all messages in one call, and returns the result of each message (in the same order)
+func (p *kafkaProducer) SendBatch(msgs []Message, r *http.Request) ([]batchResult, error) {
+	if !p.connected.Load() && p.spool == nil {
+		return nil, errNotConnected
+	}
+
+	pkgs := make([]*sarama.ProducerMessage, len(msgs))
+	for i, msg := range msgs {
+		pkg, err := p.newProducerMessage(msg, r)
+		if err != nil {
+			return nil, err
+		}
+		pkg.Metadata = i
+		pkgs[i] = pkg
+	}
+
+	results := make([]batchResult, len(msgs))
+
+	if p.async != nil {
+		for i, pkg := range pkgs {
+			results[i].Partition = -1
+			results[i].Offset = -1
+			response, err := p.sendAsync(pkg)
+			if err != nil {
+				_, results[i].Code = classifySendError(err)
+				results[i].Error = err.Error()
+				continue
+			}
+			results[i].ID = response.ID
+			results[i].Status = response.Status
+		}
+		log.AddRequestFields(r, "batch", len(msgs))
+		return results, nil
+	}
+
+	if p.shouldSpool() {
+		for i, pkg := range pkgs {
+			p.spoolResult(&results[i], pkg, pkg.Partition)
+		}
+		log.AddRequestFields(r, "batch", len(msgs), "spooled", len(msgs))
+		return results, nil
+	}
+
+	requested := make([]int32, len(pkgs))
+	for i, pkg := range pkgs {
+		requested[i] = pkg.Partition
+	}
+
+	err := p.sendMessages(pkgs)
+	if err != nil {
+		var perrs sarama.ProducerErrors
+		if !errors.As(err, &perrs) {
+			return nil, err
+		}
+		for _, perr := range perrs {
+			if i, ok := perr.Msg.Metadata.(int); ok {
+				if p.canSpool(perr.Err) {
+					p.spoolResult(&results[i], perr.Msg, requested[i])
+					continue
+				}
+				_, results[i].Code = classifySendError(perr.Err)
+				results[i].Error = perr.Err.Error()
+			}
+		}
+	}
+
+	var sent int
+	for i, pkg := range pkgs {
+		if results[i].Status == deliverySpooled {
+			continue
+		}
+		if results[i].Error != "" {
+			results[i].Partition = -1
+			results[i].Offset = -1
+			continue
+		}
+		results[i].Partition = pkg.Partition
+		results[i].Offset = pkg.Offset
+		metrics.Send(pkg.Topic, pkg.Partition, len(msgs[i].Body))
+		sent++
+	}
+	log.Trace().Msgf("%s: batch sent: %d of %d", p.ID, sent, len(msgs))
+
+	log.AddRequestFields(r, "batch", len(msgs), "sent", sent)
+
+	return results, nil
+}
+
+// valueLength is the size of the value (a tombstone has none)
+func valueLength(pkg *sarama.ProducerMessage) int {
+	if pkg.Value == nil {
+		return 0
+	}
+	return pkg.Value.Length()
+}
+
+func (p *kafkaProducer) sendMessage(pkg *sarama.ProducerMessage) (int32, int64, error) {
+	if !p.Tuning.Transactional() {
+		return p.msg.SendMessage(pkg)
+	}
+
+	var partition int32
+	var offset int64
+	err := p.inTransaction(func() error {
+		var err error
+		partition, offset, err = p.msg.SendMessage(pkg)
+		return err
+	})
+	return partition, offset, err
+}
+
+// sendMessages sends all messages, in a transactional producer either all or none are committed
+func (p *kafkaProducer) sendMessages(pkgs []*sarama.ProducerMessage) error {
+	if !p.Tuning.Transactional() {
+		return p.msg.SendMessages(pkgs)
+	}
+
+	err := p.inTransaction(func() error {
+		return p.msg.SendMessages(pkgs)
+	})
+	if err == nil {
+		return nil
+	}
+
+	// nothing was committed, so every message has failed
+	perrs := make(sarama.ProducerErrors, len(pkgs))
+	for i, pkg := range pkgs {
+		perrs[i] = &sarama.ProducerError{Msg: pkg, Err: err}
+	}
+	return perrs
+}
+
+// inTransaction runs 'send' in a transaction, which is aborted if anything fails
+func (p *kafkaProducer) inTransaction(send func() error) error {
+	p.txnLock.Lock()
+	defer p.txnLock.Unlock()
+
+	if err := p.msg.BeginTxn(); err != nil {
+		return err
+	}
+
+	err := send()
+	if err == nil {
+		err = p.msg.CommitTxn()
+		if err == nil {
+			return nil
+		}
+	}
+
+	log.Warn().Msgf("%s: aborting transaction: %v", p.ID, err)
+	if abortErr := p.msg.AbortTxn(); abortErr != nil {
+		log.Error().Msgf("%s: unable to abort transaction: %v", p.ID, abortErr)
+	}
+	return err
+}
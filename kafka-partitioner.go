@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// Machine-readable error-codes for partition-selection
+const (
+	codeInvalidPartition  = "invalid-partition"
+	codePartitionRequired = "partition-required"
+)
+
+var errPartitionRequired = stringError("a partition is required ('Melp-Partition' header)")
+
+// Partitioners
+const (
+	partitionerFNV        = "fnv"
+	partitionerMurmur2    = "murmur2"
+	partitionerHash       = "hash"
+	partitionerRoundRobin = "roundrobin"
+	partitionerRandom     = "random"
+	partitionerManual     = "manual"
+)
+
+// noPartition is used when the caller didn't select a partition
+const noPartition = -1
+
+var partitioners = map[string]sarama.PartitionerConstructor{
+	partitionerFNV:        sarama.NewHashPartitioner,
+	partitionerMurmur2:    sarama.NewCustomPartitioner(sarama.WithAbsFirst(), sarama.WithCustomHashFunction(newMurmur2)),
+	partitionerHash:       sarama.NewCustomPartitioner(sarama.WithAbsFirst(), sarama.WithCustomHashFunction(newMurmur2)),
+	partitionerRoundRobin: sarama.NewRoundRobinPartitioner,
+	partitionerRandom:     sarama.NewRandomPartitioner,
+	partitionerManual:     sarama.NewManualPartitioner,
+}
+
+func validatePartitioner(name string) (string, error) {
+	if name == "" {
+		return partitionerFNV, nil
+	}
+	name = strings.ReplaceAll(strings.ToLower(name), "-", "")
+	if _, ok := partitioners[name]; !ok {
+		return name, stringError("'partitioner' must be one of fnv, hash (murmur2), roundrobin, random or manual")
+	}
+	return name, nil
+}
+
+// newPartitioner returns a constructor for a partitioner that uses the selected partition of a message,
+// and otherwise the named partitioner
+func newPartitioner(name string) sarama.PartitionerConstructor {
+	constructor := partitioners[name]
+	return func(topic string) sarama.Partitioner {
+		return &melpPartitioner{
+			fallback: constructor(topic),
+		}
+	}
+}
+
+type melpPartitioner struct {
+	fallback sarama.Partitioner
+}
+
+func (p *melpPartitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if msg.Partition == noPartition {
+		return p.fallback.Partition(msg, numPartitions)
+	}
+	if msg.Partition >= numPartitions {
+		return -1, sarama.ErrInvalidPartition
+	}
+	return msg.Partition, nil
+}
+
+func (p *melpPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+// MessageRequiresConsistency is true when a partition is selected (so that the index is the partition-number)
+func (p *melpPartitioner) MessageRequiresConsistency(msg *sarama.ProducerMessage) bool {
+	if msg.Partition != noPartition {
+		return true
+	}
+	if dcp, ok := p.fallback.(sarama.DynamicConsistencyPartitioner); ok {
+		return dcp.MessageRequiresConsistency(msg)
+	}
+	return p.fallback.RequiresConsistency()
+}
+
+// selectPartition returns the partition the caller selected (or 'noPartition')
+func (p *kafkaProducer) selectPartition(msg *Message) (int32, error) {
+	text := msg.Metadata[PARTITION]
+	if text == "" {
+		if p.Partitioner == partitionerManual {
+			return noPartition, newProblem(http.StatusBadRequest, codePartitionRequired, errPartitionRequired)
+		}
+		return noPartition, nil
+	}
+
+	partition, err := strconv.ParseInt(text, 10, 32)
+	if err != nil || partition < 0 {
+		return noPartition, newProblem(http.StatusBadRequest, codeInvalidPartition, fmt.Errorf("invalid partition '%s'", text))
+	}
+	return int32(partition), nil
+}
+
+// murmur2 is the hash used by the Java Kafka-client to select partition
+type murmur2 struct {
+	data []byte
+}
+
+func newMurmur2() hash.Hash32 {
+	return new(murmur2)
+}
+
+func (m *murmur2) Write(p []byte) (int, error) {
+	m.data = append(m.data, p...)
+	return len(p), nil
+}
+
+func (m *murmur2) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, m.Sum32())
+}
+
+func (m *murmur2) Reset() {
+	m.data = m.data[:0]
+}
+
+func (m *murmur2) Size() int {
+	return 4
+}
+
+func (m *murmur2) BlockSize() int {
+	return 4
+}
+
+// Sum32 is a port of 'org.apache.kafka.common.utils.Utils.murmur2'
+func (m *murmur2) Sum32() uint32 {
+	const (
+		seed = 0x9747b28c
+		mult = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(m.data)
+	h := uint32(seed) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(m.data[i:])
+		k *= mult
+		k ^= k >> r
+		k *= mult
+		h *= mult
+		h ^= k
+	}
+
+	tail := m.data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= mult
+	}
+
+	h ^= h >> 13
+	h *= mult
+	h ^= h >> 15
+	return h
+}
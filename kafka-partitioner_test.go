@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// the values of 'Utils.murmur2' and 'Utils.toPositive(hash) % partitions' in the Java Kafka-client
+var javaMurmur2 = []struct {
+	key        string
+	hash       int32
+	partitions map[int32]int32
+}{
+	{"21", -973932308, map[int32]int32{3: 0, 7: 3, 12: 0}},
+	{"foobar", -790332482, map[int32]int32{3: 0, 7: 0, 12: 6}},
+	{"", 275646681, map[int32]int32{3: 0, 7: 2, 12: 9}},
+	{"a-little-bit-long-string", -985981536, map[int32]int32{3: 2, 7: 1, 12: 8}},
+	{"abc", 479470107, map[int32]int32{3: 0, 7: 4, 12: 3}},
+}
+
+func TestMurmur2(t *testing.T) {
+	h := newMurmur2()
+	for _, tt := range javaMurmur2 {
+		h.Reset()
+		_, _ = h.Write([]byte(tt.key))
+		if got := int32(h.Sum32()); got != tt.hash {
+			t.Errorf("murmur2(%q) = %d, want %d", tt.key, got, tt.hash)
+		}
+	}
+}
+
+func TestMurmur2Partition(t *testing.T) {
+	for _, name := range []string{partitionerMurmur2, partitionerHash} {
+		partitioner := newPartitioner(name)("topic")
+		for _, tt := range javaMurmur2 {
+			for n, want := range tt.partitions {
+				msg := &sarama.ProducerMessage{Key: sarama.ByteEncoder(tt.key), Partition: noPartition}
+				got, err := partitioner.Partition(msg, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("%s: partition of %q with %d partitions = %d, want %d", name, tt.key, n, got, want)
+				}
+			}
+		}
+	}
+}
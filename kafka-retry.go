@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ninlil/butler/log"
+)
+
+// Headers of records in a retry-topic
+const (
+	retryTierHeader      = "Melp-Retry-Tier"
+	retryDueHeader       = "Melp-Retry-Due"
+	retryErrorHeader     = "Melp-Retry-Error"
+	retryTopicHeader     = "Melp-Retry-Topic"
+	retryPartitionHeader = "Melp-Retry-Partition"
+	retryOffsetHeader    = "Melp-Retry-Offset"
+)
+
+// recordOrigin is where a message was first read from
+type recordOrigin struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// retryTopicsConfig is a chain of topics where failed messages wait before they are retried
+// (the topics are on the same endpoint as the consumer, that also reads them)
+type retryTopicsConfig struct {
+	Delays []time.Duration `json:"delays" yaml:"delays"`
+}
+
+// retryTopics republishes failed messages to the next retry-topic
+type retryTopics struct {
+	cfg      *retryTopicsConfig
+	endpoint *kafkaEndpoint
+	client   sarama.Client
+	producer sarama.SyncProducer
+
+	names map[string]bool // the retry-topics of the consumer
+}
+
+func (rt *retryTopics) Validate() []error {
+	var errs []error
+
+	if len(rt.cfg.Delays) == 0 {
+		errs = append(errs, requiredError("retryTopics.delays"))
+	}
+	for i, delay := range rt.cfg.Delays {
+		if delay <= 0 {
+			errs = append(errs, invalidError(fmt.Sprintf("retryTopics.delays[%d]", i)))
+		}
+	}
+
+	return errs
+}
+
+// Connect the producer, all the retry-topics of 'topics' must exist
+func (rt *retryTopics) Connect(id string, topics []string) error {
+	if rt.producer != nil {
+		return nil
+	}
+
+	rt.names = make(map[string]bool)
+	for _, topic := range rt.Topics(topics) {
+		rt.names[topic] = true
+	}
+
+	cfg := sarama.NewConfig()
+	cfg.ClientID = fmt.Sprintf("melp-retry-%s", id)
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	rt.endpoint.SetConfig(cfg)
+
+	client, err := sarama.NewClient(rt.endpoint.Peers(), cfg)
+	if err != nil {
+		return err
+	}
+
+	// the consumer can't start if a topic is missing
+	existing, err := client.Topics()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	found := make(map[string]bool, len(existing))
+	for _, topic := range existing {
+		found[topic] = true
+	}
+	var missing []string
+	for _, topic := range rt.Topics(topics) {
+		if !found[topic] {
+			missing = append(missing, topic)
+		}
+	}
+	if len(missing) > 0 {
+		client.Close()
+		return fmt.Errorf("retry-topics not found: %s", strings.Join(missing, ", "))
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	rt.client = client
+	rt.producer = producer
+	return nil
+}
+
+func (rt *retryTopics) Close() error {
+	if rt.producer == nil {
+		return nil
+	}
+	err := rt.producer.Close()
+	if clErr := rt.client.Close(); err == nil {
+		err = clErr
+	}
+	rt.producer = nil
+	rt.client = nil
+	return err
+}
+
+// Topics returns the retry-topics of each topic
+func (rt *retryTopics) Topics(topics []string) []string {
+	var list []string
+	for _, topic := range topics {
+		for _, delay := range rt.cfg.Delays {
+			list = append(list, retryTopicName(topic, delay))
+		}
+	}
+	return list
+}
+
+// retryTopicName is '<topic>.retry-<delay>', like 'orders.retry-5m'
+func retryTopicName(topic string, delay time.Duration) string {
+	var suffix string
+	switch {
+	case delay%time.Hour == 0:
+		suffix = fmt.Sprintf("%dh", delay/time.Hour)
+	case delay%time.Minute == 0:
+		suffix = fmt.Sprintf("%dm", delay/time.Minute)
+	case delay%time.Second == 0:
+		suffix = fmt.Sprintf("%ds", delay/time.Second)
+	default:
+		suffix = fmt.Sprintf("%dms", delay/time.Millisecond)
+	}
+	return topic + ".retry-" + suffix
+}
+
+// isRetryHeader is true for the headers set on records in a retry-topic
+func isRetryHeader(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), "melp-retry-")
+}
+
+// recordHeader returns a retry-header of the message, the headers are only trusted in the retry-topics
+// (anyone can set them on a record in the main topics)
+func (rt *retryTopics) recordHeader(message *sarama.ConsumerMessage, key string) string {
+	if rt == nil || !rt.names[message.Topic] {
+		return ""
+	}
+	for _, h := range message.Headers {
+		if h != nil && strings.EqualFold(string(h.Key), key) {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Tier is the number of times the message has been sent to a retry-topic (0 for the original)
+func (rt *retryTopics) Tier(message *sarama.ConsumerMessage) int {
+	tier, _ := strconv.Atoi(rt.recordHeader(message, retryTierHeader))
+	return max(tier, 0)
+}
+
+// Origin returns where the message was first read from
+func (rt *retryTopics) Origin(message *sarama.ConsumerMessage) recordOrigin {
+	topic := rt.recordHeader(message, retryTopicHeader)
+	if topic == "" {
+		return recordOrigin{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset}
+	}
+	partition, _ := strconv.ParseInt(rt.recordHeader(message, retryPartitionHeader), 10, 32)
+	offset, _ := strconv.ParseInt(rt.recordHeader(message, retryOffsetHeader), 10, 64)
+	return recordOrigin{Topic: topic, Partition: int32(partition), Offset: offset}
+}
+
+// Remaining is the time until the message is due (or 0)
+func (rt *retryTopics) Remaining(message *sarama.ConsumerMessage) time.Duration {
+	due, err := strconv.ParseInt(rt.recordHeader(message, retryDueHeader), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return max(time.Until(time.UnixMilli(due)), 0)
+}
+
+// Wait until the message is due, returns false if the context is done before that
+func (rt *retryTopics) Wait(ctx context.Context, message *sarama.ConsumerMessage) bool {
+	wait := rt.Remaining(message)
+	if wait == 0 {
+		return true
+	}
+
+	log.Trace().Msgf("retry: waiting %v for %s/%d/%d", wait, message.Topic, message.Partition, message.Offset)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Send the message to the next retry-topic, returns false when all retry-topics have been used
+func (rt *retryTopics) Send(consumer string, message *sarama.ConsumerMessage, cause error) (bool, error) {
+	if rt.producer == nil {
+		return false, errNotConnected
+	}
+
+	tier := rt.Tier(message)
+	if tier >= len(rt.cfg.Delays) {
+		return false, nil
+	}
+	delay := rt.cfg.Delays[tier]
+	origin := rt.Origin(message)
+
+	hdrs := make([]sarama.RecordHeader, 0, len(message.Headers)+6)
+	for _, h := range message.Headers {
+		if h != nil && !isRetryHeader(string(h.Key)) {
+			hdrs = append(hdrs, *h)
+		}
+	}
+	add := func(key, value string) {
+		hdrs = append(hdrs, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	add(retryTierHeader, strconv.Itoa(tier+1))
+	add(retryDueHeader, strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10))
+	add(retryErrorHeader, cause.Error())
+	add(retryTopicHeader, origin.Topic)
+	add(retryPartitionHeader, strconv.FormatInt(int64(origin.Partition), 10))
+	add(retryOffsetHeader, strconv.FormatInt(origin.Offset, 10))
+
+	topic := retryTopicName(origin.Topic, delay)
+	pkg := &sarama.ProducerMessage{
+		Topic:     topic,
+		Headers:   hdrs,
+		Timestamp: message.Timestamp,
+	}
+	if message.Key != nil {
+		pkg.Key = sarama.ByteEncoder(message.Key)
+	}
+	if message.Value != nil {
+		pkg.Value = sarama.ByteEncoder(message.Value)
+	}
+
+	if _, _, err := rt.producer.SendMessage(pkg); err != nil {
+		return false, err
+	}
+	log.Warn().
+		Str("topic", message.Topic).
+		Int32("partition", message.Partition).
+		Int64("offset", message.Offset).
+		Msgf("%s: message sent to retry-topic '%s'", consumer, topic)
+	metrics.Retry(consumer, topic)
+	return true, nil
+}
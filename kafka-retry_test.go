@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+func TestRetryHeadersOnlyInRetryTopics(t *testing.T) {
+	rt := &retryTopics{
+		cfg:   &retryTopicsConfig{Delays: []time.Duration{time.Minute}},
+		names: map[string]bool{"orders.retry-1m": true},
+	}
+	headers := []*sarama.RecordHeader{
+		{Key: []byte(retryTierHeader), Value: []byte("1")},
+		{Key: []byte(retryDueHeader), Value: []byte("99999999999999")},
+		{Key: []byte(retryTopicHeader), Value: []byte("payments")},
+		{Key: []byte(retryPartitionHeader), Value: []byte("7")},
+		{Key: []byte(retryOffsetHeader), Value: []byte("42")},
+	}
+
+	// forged headers on a record of the main topic
+	message := &sarama.ConsumerMessage{Topic: "orders", Partition: 1, Offset: 10, Headers: headers}
+	for _, rt := range []*retryTopics{rt, nil} {
+		if tier := rt.Tier(message); tier != 0 {
+			t.Errorf("Tier = %d, want 0", tier)
+		}
+		if wait := rt.Remaining(message); wait != 0 {
+			t.Errorf("Remaining = %v, want 0", wait)
+		}
+		if origin := rt.Origin(message); origin != (recordOrigin{Topic: "orders", Partition: 1, Offset: 10}) {
+			t.Errorf("Origin = %+v", origin)
+		}
+	}
+
+	message = &sarama.ConsumerMessage{Topic: "orders.retry-1m", Partition: 0, Offset: 3, Headers: headers}
+	if tier := rt.Tier(message); tier != 1 {
+		t.Errorf("Tier = %d, want 1", tier)
+	}
+	if wait := rt.Remaining(message); wait == 0 {
+		t.Error("Remaining = 0, want the time until due")
+	}
+	if origin := rt.Origin(message); origin != (recordOrigin{Topic: "payments", Partition: 7, Offset: 42}) {
+		t.Errorf("Origin = %+v", origin)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ninlil/butler/log"
+)
+
+// Machine-readable error-codes for the spool
+const (
+	codeSpoolFull = "spool-full"
+)
+
+const deliverySpooled = "spooled"
+
+const spoolExt = ".json"
+
+var errSpoolFull = stringError("spool is full")
+
+// spoolConfig is the (optional) store-and-forward spool of a producer
+type spoolConfig struct {
+	Dir         string        `json:"dir" yaml:"dir"`
+	MaxBytes    int64         `json:"maxBytes" yaml:"maxBytes"`
+	MaxMessages int           `json:"maxMessages" yaml:"maxMessages"`
+	MaxAge      time.Duration `json:"maxAge" yaml:"maxAge"`
+}
+
+func (cfg *spoolConfig) Validate() []error {
+	var errs []error
+
+	if cfg.Dir == "" {
+		errs = append(errs, requiredError("spool.dir"))
+	}
+	if cfg.MaxBytes < 0 {
+		errs = append(errs, invalidError("spool.maxBytes"))
+	}
+	if cfg.MaxMessages < 0 {
+		errs = append(errs, invalidError("spool.maxMessages"))
+	}
+	if cfg.MaxAge < 0 {
+		errs = append(errs, invalidError("spool.maxAge"))
+	}
+
+	return errs
+}
+
+type spoolHeader struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// spoolRecord is a message waiting in the spool
+type spoolRecord struct {
+	Topic     string        `json:"topic"`
+	Partition int32         `json:"partition"`
+	Key       []byte        `json:"key,omitempty"`
+	Value     []byte        `json:"value"`
+	Headers   []spoolHeader `json:"headers,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+	Spooled   time.Time     `json:"spooled"`
+}
+
+func newSpoolRecord(pkg *sarama.ProducerMessage) (*spoolRecord, error) {
+	rec := &spoolRecord{
+		Topic:     pkg.Topic,
+		Partition: pkg.Partition,
+		Timestamp: pkg.Timestamp,
+		Spooled:   time.Now().UTC(),
+	}
+
+	var err error
+	if pkg.Key != nil {
+		if rec.Key, err = pkg.Key.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	if pkg.Value != nil {
+		if rec.Value, err = pkg.Value.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range pkg.Headers {
+		rec.Headers = append(rec.Headers, spoolHeader{Key: h.Key, Value: h.Value})
+	}
+	return rec, nil
+}
+
+func (rec *spoolRecord) ProducerMessage() *sarama.ProducerMessage {
+	pkg := &sarama.ProducerMessage{
+		Topic:     rec.Topic,
+		Partition: rec.Partition,
+		Timestamp: rec.Timestamp,
+	}
+	if rec.Value != nil {
+		pkg.Value = sarama.ByteEncoder(rec.Value)
+	}
+	if rec.Key != nil {
+		pkg.Key = sarama.ByteEncoder(rec.Key)
+	}
+	for _, h := range rec.Headers {
+		pkg.Headers = append(pkg.Headers, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return pkg
+}
+
+// kafkaSpool is a directory with one file per message, named by sequence-number to keep the order
+type kafkaSpool struct {
+	cfg *spoolConfig
+	id  string
+
+	lock  sync.Mutex
+	seq   uint64
+	files []string
+	sizes map[string]int64
+	bytes int64
+}
+
+func openSpool(id string, cfg *spoolConfig) (*kafkaSpool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := &kafkaSpool{
+		cfg:   cfg,
+		id:    id,
+		sizes: make(map[string]int64),
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		spool.files = append(spool.files, name)
+		spool.sizes[name] = info.Size()
+		spool.bytes += info.Size()
+		if seq > spool.seq {
+			spool.seq = seq
+		}
+	}
+	sort.Strings(spool.files)
+
+	if len(spool.files) > 0 {
+		log.Info().Msgf("%s: spool has %d messages waiting", id, len(spool.files))
+	}
+	spool.updateMetrics()
+
+	return spool, nil
+}
+
+// Depth is the number of messages waiting in the spool
+func (spool *kafkaSpool) Depth() int {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	return len(spool.files)
+}
+
+// Add a message to the spool, returns the id of the spooled message
+func (spool *kafkaSpool) Add(pkg *sarama.ProducerMessage) (string, error) {
+	rec, err := newSpoolRecord(pkg)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if spool.cfg.MaxMessages > 0 && len(spool.files) >= spool.cfg.MaxMessages {
+		return "", newProblem(http.StatusServiceUnavailable, codeSpoolFull, errSpoolFull)
+	}
+	if spool.cfg.MaxBytes > 0 && spool.bytes+int64(len(buf)) > spool.cfg.MaxBytes {
+		return "", newProblem(http.StatusServiceUnavailable, codeSpoolFull, errSpoolFull)
+	}
+
+	spool.seq++
+	name := fmt.Sprintf("%020d%s", spool.seq, spoolExt)
+
+	// write to a temp-file first, so that a crash never leaves half a message
+	tmp := filepath.Join(spool.cfg.Dir, name+".tmp")
+	if err := writeFileSync(tmp, buf, 0o640); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(spool.cfg.Dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	// the rename is only durable when the directory is synced (the message is in the spool either way)
+	if err := syncDir(spool.cfg.Dir); err != nil {
+		log.Warn().Msgf("unable to sync spool-dir '%s': %v", spool.cfg.Dir, err)
+	}
+
+	spool.files = append(spool.files, name)
+	spool.sizes[name] = int64(len(buf))
+	spool.bytes += int64(len(buf))
+	spool.updateMetrics()
+
+	return strings.TrimSuffix(name, spoolExt), nil
+}
+
+// Peek returns the oldest message in the spool
+func (spool *kafkaSpool) Peek() (string, *spoolRecord, error) {
+	spool.lock.Lock()
+	if len(spool.files) == 0 {
+		spool.lock.Unlock()
+		return "", nil, nil
+	}
+	name := spool.files[0]
+	spool.lock.Unlock()
+
+	buf, err := os.ReadFile(filepath.Join(spool.cfg.Dir, name))
+	if err != nil {
+		return name, nil, err
+	}
+
+	var rec spoolRecord
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return name, nil, err
+	}
+	return name, &rec, nil
+}
+
+// Remove the (oldest) message from the spool
+func (spool *kafkaSpool) Remove(name string) error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if len(spool.files) == 0 || spool.files[0] != name {
+		return nil
+	}
+
+	if err := os.Remove(filepath.Join(spool.cfg.Dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	spool.files = spool.files[1:]
+	spool.bytes -= spool.sizes[name]
+	delete(spool.sizes, name)
+	spool.updateMetrics()
+	return nil
+}
+
+func (spool *kafkaSpool) updateMetrics() {
+	metrics.Spool(spool.id, len(spool.files), spool.bytes)
+}
+
+// spoolMessage stores the message in the spool, to be sent when the broker is available again
+// ('partition' is the partition that was requested, before the partitioner selected one)
+func (p *kafkaProducer) spoolMessage(pkg *sarama.ProducerMessage, partition int32) (*kafkaAsyncResponse, error) {
+	pkg.Partition = partition
+	id, err := p.spool.Add(pkg)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Msgf("%s: message spooled as '%s'", p.ID, id)
+	return &kafkaAsyncResponse{
+		ID:     id,
+		Status: deliverySpooled,
+	}, nil
+}
+
+// spoolResult spools a message in a batch
+func (p *kafkaProducer) spoolResult(result *batchResult, pkg *sarama.ProducerMessage, partition int32) {
+	result.Partition = -1
+	result.Offset = -1
+
+	response, err := p.spoolMessage(pkg, partition)
+	if err != nil {
+		_, result.Code = classifySendError(err)
+		if prob, ok := err.(*problem); ok {
+			result.Code = prob.Code
+		}
+		result.Error = err.Error()
+		return
+	}
+	result.ID = response.ID
+	result.Status = response.Status
+}
+
+// shouldSpool is true if the message should go to the spool instead of the broker,
+// while the spool has messages waiting all new messages must be spooled to keep the order
+func (p *kafkaProducer) shouldSpool() bool {
+	return p.spool != nil && (!p.connected.Load() || p.spool.Depth() > 0)
+}
+
+// canSpool is true if the error means the broker is unavailable
+func (p *kafkaProducer) canSpool(err error) bool {
+	if p.spool == nil {
+		return false
+	}
+	status, _ := classifySendError(err)
+	return status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// replaySpool reconnects (if needed) and sends all spooled messages in order, runs until the producer is closed
+func (p *kafkaProducer) replaySpool() {
+	for !p.closed.Load() {
+		time.Sleep(reconnectDelay())
+
+		if !p.connected.Load() {
+			if _, err := p.Connect(); err != nil {
+				log.Warn().Msgf("%s: unable to reconnect: %v", p.ID, err)
+				continue
+			}
+			log.Info().Msgf("%s: reconnected", p.ID)
+		}
+
+		p.drainSpool()
+	}
+}
+
+func (p *kafkaProducer) drainSpool() {
+	for !p.closed.Load() {
+		name, rec, err := p.spool.Peek()
+		if err != nil {
+			log.Error().Msgf("%s: unable to read spooled message '%s', skipping it: %v", p.ID, name, err)
+			metrics.SpoolDropped(p.ID)
+			_ = p.spool.Remove(name)
+			continue
+		}
+		if rec == nil {
+			return
+		}
+
+		if p.spool.cfg.MaxAge > 0 && time.Since(rec.Spooled) > p.spool.cfg.MaxAge {
+			log.Warn().Msgf("%s: spooled message '%s' is too old, dropping it", p.ID, name)
+			metrics.SpoolDropped(p.ID)
+			_ = p.spool.Remove(name)
+			continue
+		}
+
+		pkg := rec.ProducerMessage()
+		partition, offset, err := p.sendMessage(pkg)
+		if err != nil {
+			if p.canSpool(err) {
+				log.Warn().Msgf("%s: broker still unavailable, %d messages in spool: %v", p.ID, p.spool.Depth(), err)
+				return
+			}
+			log.Error().Msgf("%s: spooled message '%s' was rejected, dropping it: %v", p.ID, name, err)
+			metrics.SpoolDropped(p.ID)
+		} else {
+			log.Trace().Msgf("%s: spooled message '%s' sent: %d/%d", p.ID, name, partition, offset)
+			metrics.Send(pkg.Topic, partition, len(rec.Value))
+		}
+
+		if err := p.spool.Remove(name); err != nil {
+			log.Error().Msgf("%s: unable to remove spooled message '%s': %v", p.ID, name, err)
+			return
+		}
+	}
+}
+
+// writeFileSync writes the file and flushes it to disk
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the entries of the directory to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
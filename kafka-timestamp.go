@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Machine-readable error-codes for timestamps
+const (
+	codeInvalidTimestamp = "invalid-timestamp"
+)
+
+var errTimestampSkew = stringError("timestamp is too far from the current time")
+
+// timestampConfig is where the record-timestamp is taken from,
+// if no 'Melp-Timestamp' header is set
+type timestampConfig struct {
+	Pointer string        `json:"pointer" yaml:"pointer"`
+	MaxSkew time.Duration `json:"maxSkew" yaml:"maxSkew"`
+}
+
+func (cfg *timestampConfig) Validate() []error {
+	var errs []error
+
+	if cfg.Pointer != "" && !strings.HasPrefix(cfg.Pointer, "/") {
+		errs = append(errs, invalidError("timestamp.pointer"))
+	}
+	if cfg.MaxSkew < 0 {
+		errs = append(errs, invalidError("timestamp.maxSkew"))
+	}
+
+	return errs
+}
+
+// parseTimestamp accepts RFC 3339 or milliseconds since the epoch
+func parseTimestamp(text string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	ts, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp '%s' (use RFC 3339 or epoch-milliseconds)", text)
+	}
+	return ts.UTC(), nil
+}
+
+// requestTimestamp returns the timestamp from the 'Melp-Timestamp' header (or zero if not set)
+func requestTimestamp(r *http.Request) (time.Time, *problem) {
+	text := r.Header.Get("Melp-Timestamp")
+	if text == "" {
+		return time.Time{}, nil
+	}
+	ts, err := parseTimestamp(text)
+	if err != nil {
+		return time.Time{}, newProblem(http.StatusBadRequest, codeInvalidTimestamp, err)
+	}
+	return ts, nil
+}
+
+// selectTimestamp returns the timestamp of the record: from the caller, the body or the current time
+func (p *kafkaProducer) selectTimestamp(msg *Message, r *http.Request) (time.Time, error) {
+	now := time.Now().UTC()
+	ts := msg.Timestamp
+
+	if ts.IsZero() && p.Timestamp != nil && p.Timestamp.Pointer != "" {
+		if text, ok := newMessageContext(msg, r).Field(p.Timestamp.Pointer); ok {
+			var err error
+			if ts, err = parseTimestamp(text); err != nil {
+				return ts, newProblem(http.StatusBadRequest, codeInvalidTimestamp, err)
+			}
+		}
+	}
+
+	if ts.IsZero() {
+		return now, nil
+	}
+
+	if p.Timestamp != nil && p.Timestamp.MaxSkew > 0 {
+		skew := now.Sub(ts)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > p.Timestamp.MaxSkew {
+			return ts, newProblem(http.StatusBadRequest, codeInvalidTimestamp, errTimestampSkew)
+		}
+	}
+
+	return ts, nil
+}
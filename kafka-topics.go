@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/ninlil/butler/log"
+)
+
+// Machine-readable error-codes for topic-selection
+const (
+	codeTopicNotAllowed = "topic-not-allowed"
+	codeInvalidTopic    = "invalid-topic"
+)
+
+var validTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// topicSelector decides which topics a caller may select
+type topicSelector struct {
+	Allowed []string
+	Pattern string
+
+	pattern *regexp.Regexp
+}
+
+func (ts *topicSelector) Validate() []error {
+	var errs []error
+
+	if ts.Pattern != "" {
+		// the pattern must match the whole topic-name
+		re, err := regexp.Compile("^(?:" + ts.Pattern + ")$")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("'allowedTopicPattern' is invalid: %v", err))
+		}
+		ts.pattern = re
+	}
+
+	return errs
+}
+
+// IsAllowed returns true if the caller may send to 'topic'
+func (ts *topicSelector) IsAllowed(topic string) bool {
+	for _, allowed := range ts.Allowed {
+		if topic == allowed {
+			return true
+		}
+	}
+	return ts.pattern != nil && ts.pattern.MatchString(topic)
+}
+
+// topicRoute is a rule that selects the topic from the content of a message
+type topicRoute struct {
+	Name   string `json:"name" yaml:"name"`
+	Header string `json:"header" yaml:"header"`
+	Field  string `json:"field" yaml:"field"`
+	Match  string `json:"match" yaml:"match"`
+	Topic  string `json:"topic" yaml:"topic"`
+
+	match *regexp.Regexp
+	topic *messageTemplate
+}
+
+func (route *topicRoute) Validate(i int) []error {
+	var errs []error
+
+	if route.Name == "" {
+		route.Name = "#" + strconv.Itoa(i)
+	}
+
+	if route.Header != "" && route.Field != "" {
+		errs = append(errs, fmt.Errorf("route '%s': can't use both 'header' and 'field'", route.Name))
+	}
+
+	if route.Match != "" {
+		if route.Header == "" && route.Field == "" {
+			errs = append(errs, fmt.Errorf("route '%s': 'match' requires 'header' or 'field'", route.Name))
+		}
+		re, err := regexp.Compile("^(?:" + route.Match + ")$")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route '%s': 'match' is invalid: %v", route.Name, err))
+		}
+		route.match = re
+	}
+
+	if route.Topic == "" {
+		errs = append(errs, fmt.Errorf("route '%s': %w", route.Name, requiredError(TOPIC)))
+	} else {
+		tmpl, err := newMessageTemplate(route.Name, route.Topic)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route '%s': 'topic' is invalid: %v", route.Name, err))
+		}
+		route.topic = tmpl
+	}
+
+	return errs
+}
+
+// Matches returns true if the message matches the 'header' or 'field' (and 'match') of the route
+func (route *topicRoute) Matches(mc *messageContext) bool {
+	var value string
+	switch {
+	case route.Header != "":
+		value = mc.Header(route.Header)
+		if value == "" {
+			return false
+		}
+	case route.Field != "":
+		v, ok := mc.Field(route.Field)
+		if !ok {
+			return false
+		}
+		value = v
+	}
+
+	return route.match == nil || route.match.MatchString(value)
+}
+
+// selectTopic returns the topic to send the message to
+func (p *kafkaProducer) selectTopic(msg *Message, r *http.Request) (string, error) {
+	topic := msg.Metadata[TOPIC]
+	if topic == p.Topic {
+		return p.Topic, nil
+	}
+
+	if topic != "" {
+		if !p.Topics.IsAllowed(topic) {
+			return "", newProblem(http.StatusForbidden, codeTopicNotAllowed, fmt.Errorf("topic '%s' is not allowed", topic))
+		}
+		return topic, nil
+	}
+
+	if len(p.Routes) == 0 {
+		return p.Topic, nil
+	}
+
+	mc := newMessageContext(msg, r)
+	for _, route := range p.Routes {
+		if !route.Matches(mc) {
+			continue
+		}
+		topic, err := route.topic.Execute(mc)
+		if err != nil {
+			log.Debug().Msgf("%s: route '%s' skipped: %v", p.ID, route.Name, err)
+			continue
+		}
+		if !validTopic.MatchString(topic) {
+			return "", newProblem(http.StatusBadRequest, codeInvalidTopic, fmt.Errorf("route '%s' resolved to invalid topic '%s'", route.Name, topic))
+		}
+		metrics.Route(p.ID, route.Name, topic)
+		return topic, nil
+	}
+
+	metrics.Route(p.ID, "default", p.Topic)
+	return p.Topic, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// defaults for the producer (same as before tuning was configurable)
+const (
+	defaultAcks        = "leader"
+	defaultCompression = "snappy"
+	defaultRetries     = 10
+)
+
+var producerAcks = map[string]sarama.RequiredAcks{
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+var producerCompression = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+// kafkaProducerTuning is the optional tuning of a producer
+type kafkaProducerTuning struct {
+	Acks            string        `json:"acks" yaml:"acks"`
+	Compression     string        `json:"compression" yaml:"compression"`
+	MaxMessageBytes int           `json:"maxMessageBytes" yaml:"maxMessageBytes"`
+	Retries         *int          `json:"retries" yaml:"retries"`
+	RetryBackoff    time.Duration `json:"retryBackoff" yaml:"retryBackoff"`
+	Linger          time.Duration `json:"linger" yaml:"linger"`
+	FlushMessages   int           `json:"flushMessages" yaml:"flushMessages"`
+	FlushBytes      int           `json:"flushBytes" yaml:"flushBytes"`
+	Timeout         time.Duration `json:"timeout" yaml:"timeout"`
+	DialTimeout     time.Duration `json:"dialTimeout" yaml:"dialTimeout"`
+	ReadTimeout     time.Duration `json:"readTimeout" yaml:"readTimeout"`
+	WriteTimeout    time.Duration `json:"writeTimeout" yaml:"writeTimeout"`
+	Idempotent      bool          `json:"idempotent" yaml:"idempotent"`
+	TransactionalID string        `json:"transactionalId" yaml:"transactionalId"`
+}
+
+// Transactional is true if messages are sent in transactions
+func (t *kafkaProducerTuning) Transactional() bool {
+	return t.TransactionalID != ""
+}
+
+func (t *kafkaProducerTuning) Validate() []error {
+	var errs []error
+
+	if t.Transactional() {
+		t.Idempotent = true
+	}
+
+	if t.Acks == "" {
+		t.Acks = defaultAcks
+		if t.Idempotent {
+			t.Acks = "all"
+		}
+	}
+	t.Acks = strings.ToLower(t.Acks)
+	if _, ok := producerAcks[t.Acks]; !ok {
+		errs = append(errs, fmt.Errorf("'tuning.acks' must be one of none, leader or all"))
+	}
+
+	if t.Compression == "" {
+		t.Compression = defaultCompression
+	}
+	t.Compression = strings.ToLower(t.Compression)
+	if _, ok := producerCompression[t.Compression]; !ok {
+		errs = append(errs, fmt.Errorf("'tuning.compression' must be one of none, gzip, snappy, lz4 or zstd"))
+	}
+
+	if t.MaxMessageBytes < 0 {
+		errs = append(errs, invalidError("tuning.maxMessageBytes"))
+	}
+	if t.Retries == nil {
+		retries := defaultRetries
+		t.Retries = &retries
+	}
+	if *t.Retries < 0 {
+		errs = append(errs, invalidError("tuning.retries"))
+	}
+
+	if t.Idempotent {
+		if t.Acks != "all" {
+			errs = append(errs, stringError("'tuning.idempotent' requires 'acks: all'"))
+		}
+		if *t.Retries < 1 {
+			errs = append(errs, stringError("'tuning.idempotent' requires 'retries' to be at least 1"))
+		}
+	}
+
+	if t.FlushMessages < 0 {
+		errs = append(errs, invalidError("tuning.flushMessages"))
+	}
+	if t.FlushBytes < 0 {
+		errs = append(errs, invalidError("tuning.flushBytes"))
+	}
+
+	durations := []struct {
+		name string
+		dur  time.Duration
+	}{
+		{"retryBackoff", t.RetryBackoff},
+		{"linger", t.Linger},
+		{"timeout", t.Timeout},
+		{"dialTimeout", t.DialTimeout},
+		{"readTimeout", t.ReadTimeout},
+		{"writeTimeout", t.WriteTimeout},
+	}
+	for _, d := range durations {
+		if d.dur < 0 {
+			errs = append(errs, invalidError("tuning."+d.name))
+		}
+	}
+
+	return errs
+}
+
+// Apply the tuning to the sarama-config (zero values keeps the sarama defaults)
+func (t *kafkaProducerTuning) Apply(cfg *sarama.Config) {
+	cfg.Producer.RequiredAcks = producerAcks[t.Acks]
+	cfg.Producer.Compression = producerCompression[t.Compression]
+	cfg.Producer.Retry.Max = *t.Retries
+
+	if t.MaxMessageBytes > 0 {
+		cfg.Producer.MaxMessageBytes = t.MaxMessageBytes
+	}
+	if t.RetryBackoff > 0 {
+		cfg.Producer.Retry.Backoff = t.RetryBackoff
+	}
+	if t.Linger > 0 {
+		cfg.Producer.Flush.Frequency = t.Linger
+	}
+	if t.FlushMessages > 0 {
+		cfg.Producer.Flush.Messages = t.FlushMessages
+	}
+	if t.FlushBytes > 0 {
+		cfg.Producer.Flush.Bytes = t.FlushBytes
+	}
+	if t.Timeout > 0 {
+		cfg.Producer.Timeout = t.Timeout
+	}
+	if t.DialTimeout > 0 {
+		cfg.Net.DialTimeout = t.DialTimeout
+	}
+	if t.ReadTimeout > 0 {
+		cfg.Net.ReadTimeout = t.ReadTimeout
+	}
+	if t.WriteTimeout > 0 {
+		cfg.Net.WriteTimeout = t.WriteTimeout
+	}
+
+	if t.Idempotent {
+		cfg.Producer.Idempotent = true
+		cfg.Net.MaxOpenRequests = 1
+	}
+	if t.Transactional() {
+		cfg.Producer.Transaction.ID = t.TransactionalID
+	}
+}
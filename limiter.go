@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ninlil/butler/log"
+)
+
+// Machine-readable error-codes for rate-limiting
+const (
+	codeRateLimited = "rate-limited"
+	codeTooBusy     = "too-many-in-flight"
+)
+
+// callers that have been idle this long are forgotten
+const callerIdleTimeout = 10 * time.Minute
+
+// how many callers to track before idle callers are forgotten
+const callerSweepLimit = 1000
+
+var (
+	errRateLimited = stringError("rate-limit exceeded")
+	errTooBusy     = stringError("too many requests in flight")
+)
+
+// rateLimit is a token-bucket ('rate' requests per second, with 'burst') and a cap on concurrent requests
+type rateLimit struct {
+	Rate        float64 `json:"rate" yaml:"rate"`
+	Burst       int     `json:"burst" yaml:"burst"`
+	MaxInFlight int     `json:"maxInFlight" yaml:"maxInFlight"`
+}
+
+func (rl *rateLimit) Validate(name string) []error {
+	var errs []error
+
+	if rl.Rate < 0 {
+		errs = append(errs, invalidError(name+".rate"))
+	}
+	if rl.Burst < 0 {
+		errs = append(errs, invalidError(name+".burst"))
+	}
+	if rl.Rate > 0 && rl.Burst == 0 {
+		rl.Burst = int(math.Ceil(rl.Rate))
+	}
+	if rl.MaxInFlight < 0 {
+		errs = append(errs, invalidError(name+".maxInFlight"))
+	}
+
+	return errs
+}
+
+// rateLimitConfig is the limit of the producer, and of each caller
+type rateLimitConfig struct {
+	rateLimit `yaml:",inline"`
+	PerCaller *rateLimit `json:"perCaller" yaml:"perCaller"`
+}
+
+func (cfg *rateLimitConfig) Validate() []error {
+	errs := cfg.rateLimit.Validate("rateLimit")
+	if cfg.PerCaller != nil {
+		errs = append(errs, cfg.PerCaller.Validate("rateLimit.perCaller")...)
+	}
+	return errs
+}
+
+// limitState is the current state of one rate-limit
+type limitState struct {
+	limit    *rateLimit
+	tokens   float64
+	last     time.Time // when the tokens were last refilled
+	lastSeen time.Time // the last request (for forgetting idle callers)
+	inFlight int
+}
+
+func newLimitState(limit *rateLimit) *limitState {
+	return &limitState{
+		limit:    limit,
+		tokens:   float64(limit.Burst),
+		last:     time.Now(),
+		lastSeen: time.Now(),
+	}
+}
+
+// check if a request is allowed (without taking it), returns how long to wait if not
+func (ls *limitState) check(now time.Time) (time.Duration, string) {
+	if ls.limit.MaxInFlight > 0 && ls.inFlight >= ls.limit.MaxInFlight {
+		return time.Second, codeTooBusy
+	}
+
+	if ls.limit.Rate > 0 {
+		ls.tokens = math.Min(float64(ls.limit.Burst), ls.tokens+now.Sub(ls.last).Seconds()*ls.limit.Rate)
+		ls.last = now
+		if ls.tokens < 1 {
+			return time.Duration((1 - ls.tokens) / ls.limit.Rate * float64(time.Second)), codeRateLimited
+		}
+	}
+
+	return 0, ""
+}
+
+func (ls *limitState) take() {
+	if ls.limit.Rate > 0 {
+		ls.tokens--
+	}
+	ls.inFlight++
+}
+
+// rateLimiter keeps track of the limits of a producer
+type rateLimiter struct {
+	id  string
+	cfg *rateLimitConfig
+
+	lock    sync.Mutex
+	total   *limitState
+	callers map[string]*limitState
+}
+
+func newRateLimiter(id string, cfg *rateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		id:      id,
+		cfg:     cfg,
+		total:   newLimitState(&cfg.rateLimit),
+		callers: make(map[string]*limitState),
+	}
+}
+
+// Acquire a slot for a request, 'release' must be called when the request is done
+func (rl *rateLimiter) Acquire(identity string) (release func(), wait time.Duration, reason string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+
+	var caller *limitState
+	if rl.cfg.PerCaller != nil {
+		caller = rl.callers[identity]
+		if caller == nil {
+			rl.sweep(now)
+			caller = newLimitState(rl.cfg.PerCaller)
+			rl.callers[identity] = caller
+		}
+		caller.lastSeen = now
+		if wait, reason := caller.check(now); reason != "" {
+			return nil, wait, reason
+		}
+	}
+
+	if wait, reason := rl.total.check(now); reason != "" {
+		return nil, wait, reason
+	}
+
+	rl.total.take()
+	if caller != nil {
+		caller.take()
+	}
+
+	return func() {
+		rl.lock.Lock()
+		defer rl.lock.Unlock()
+		rl.total.inFlight--
+		if caller != nil {
+			caller.inFlight--
+			caller.lastSeen = time.Now()
+		}
+	}, 0, ""
+}
+
+// sweep forgets idle callers, when there are many of them
+func (rl *rateLimiter) sweep(now time.Time) {
+	if len(rl.callers) < callerSweepLimit {
+		return
+	}
+	for identity, caller := range rl.callers {
+		if caller.inFlight == 0 && now.Sub(caller.lastSeen) > callerIdleTimeout {
+			delete(rl.callers, identity)
+		}
+	}
+}
+
+// throttle checks the rate-limits of the producer, 'release' must be called when the request is done
+func throttle(p Producer, w http.ResponseWriter, r *http.Request) (func(), *problem) {
+	limiter := p.Limiter()
+	if limiter == nil {
+		return func() {}, nil
+	}
+
+	identity := p.Identity(r)
+	release, wait, reason := limiter.Acquire(identity)
+	if release != nil {
+		return release, nil
+	}
+
+	log.Debug().Msgf("%s: throttled '%s': %s", p.Name(), identity, reason)
+	metrics.Throttled(p.Name(), reason)
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	err := errRateLimited
+	if reason == codeTooBusy {
+		err = errTooBusy
+	}
+	return nil, newProblem(http.StatusTooManyRequests, reason, err)
+}
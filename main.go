@@ -11,10 +11,16 @@ import (
 
 var routes = []router.Route{
 	{Name: "send", Method: "POST", Path: "/send/{id}", Handler: send},
+	{Name: "send-batch", Method: "POST", Path: "/send/{id}/batch", Handler: sendBatch},
+	{Name: "send-status", Method: "GET", Path: "/send/{id}/status/{msgid}", Handler: sendStatus},
+	{Name: "send-topic", Method: "POST", Path: "/send/{id}/{topic}", Handler: send},
+	{Name: "send-key", Method: "POST", Path: "/send/{id}/key/{key}", Handler: send},
+	{Name: "delete-key", Method: "DELETE", Path: "/send/{id}/{key}", Handler: send},
 	{Name: "stop", Method: "GET", Path: "/stop", Handler: stop},
 }
 
 func main() {
+	parseArgs()
 	initKafka()
 
 	os.Exit(run())
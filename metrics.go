@@ -17,6 +17,13 @@ type metricsData struct {
 	// goregistry      gometrics.Registry
 	sendTotal       *prometheus.CounterVec
 	sendSizes       *prometheus.SummaryVec
+	routeTotal      *prometheus.CounterVec
+	spoolDepth      *prometheus.GaugeVec
+	spoolBytes      *prometheus.GaugeVec
+	spoolDropped    *prometheus.CounterVec
+	throttledTotal  *prometheus.CounterVec
+	deadLetterTotal *prometheus.CounterVec
+	retryTotal      *prometheus.CounterVec
 	receiveTotal    *prometheus.CounterVec
 	receiveSizes    *prometheus.SummaryVec
 	receiveDuration *prometheus.HistogramVec
@@ -39,6 +46,48 @@ func (m *metricsData) Init() http.Handler {
 			Help: "Tracks the number of bytes sent",
 		}, []string{"topic", "partition"},
 	)
+	m.routeTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "melp_route_total",
+			Help: "Tracks the number of messages per resolved route and topic.",
+		}, []string{"producer", "route", "topic"},
+	)
+	m.spoolDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "melp_spool_depth",
+			Help: "Tracks the number of messages waiting in the spool.",
+		}, []string{"producer"},
+	)
+	m.spoolBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "melp_spool_size_bytes",
+			Help: "Tracks the number of bytes waiting in the spool.",
+		}, []string{"producer"},
+	)
+	m.spoolDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "melp_spool_dropped_total",
+			Help: "Tracks the number of spooled messages that were dropped.",
+		}, []string{"producer"},
+	)
+	m.throttledTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "melp_throttled_total",
+			Help: "Tracks the number of requests rejected by rate-limits.",
+		}, []string{"producer", "reason"},
+	)
+	m.deadLetterTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "melp_dead_letter_total",
+			Help: "Tracks the number of messages sent to a dead-letter topic.",
+		}, []string{"consumer", "topic"},
+	)
+	m.retryTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "melp_retry_total",
+			Help: "Tracks the number of messages sent to a retry topic.",
+		}, []string{"consumer", "topic"},
+	)
 	m.receiveTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "melp_receive_total",
@@ -70,6 +119,13 @@ func (m *metricsData) Init() http.Handler {
 	m.registry.MustRegister(
 		metrics.sendTotal,
 		metrics.sendSizes,
+		metrics.routeTotal,
+		metrics.spoolDepth,
+		metrics.spoolBytes,
+		metrics.spoolDropped,
+		metrics.throttledTotal,
+		metrics.deadLetterTotal,
+		metrics.retryTotal,
 		metrics.receiveTotal,
 		metrics.receiveSizes,
 		metrics.receiveDuration,
@@ -93,6 +149,49 @@ func (m *metricsData) Send(topic string, partition int32, size int) {
 	m.sendSizes.WithLabelValues(topic, p).Observe(float64(size))
 }
 
+func (m *metricsData) Route(producer, route, topic string) {
+	if m.routeTotal == nil {
+		return
+	}
+	m.routeTotal.WithLabelValues(producer, route, topic).Inc()
+}
+
+func (m *metricsData) Spool(producer string, depth int, size int64) {
+	if m.spoolDepth == nil {
+		return
+	}
+	m.spoolDepth.WithLabelValues(producer).Set(float64(depth))
+	m.spoolBytes.WithLabelValues(producer).Set(float64(size))
+}
+
+func (m *metricsData) SpoolDropped(producer string) {
+	if m.spoolDropped == nil {
+		return
+	}
+	m.spoolDropped.WithLabelValues(producer).Inc()
+}
+
+func (m *metricsData) Throttled(producer, reason string) {
+	if m.throttledTotal == nil {
+		return
+	}
+	m.throttledTotal.WithLabelValues(producer, reason).Inc()
+}
+
+func (m *metricsData) DeadLetter(consumer, topic string) {
+	if m.deadLetterTotal == nil {
+		return
+	}
+	m.deadLetterTotal.WithLabelValues(consumer, topic).Inc()
+}
+
+func (m *metricsData) Retry(consumer, topic string) {
+	if m.retryTotal == nil {
+		return
+	}
+	m.retryTotal.WithLabelValues(consumer, topic).Inc()
+}
+
 func (m *metricsData) Receive(topic string, partition int32, size int, dur time.Duration, status string) {
 	if m.receiveTotal == nil {
 		return
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// Machine-readable error-codes
+const (
+	codeNoSuchProducer    = "no-such-producer"
+	codeNoSuchMessage     = "no-such-message"
+	codeUnauthorized      = "unauthorized"
+	codeInvalidRequest    = "invalid-request"
+	codeMessageTooLarge   = "message-too-large"
+	codeBrokerUnavailable = "broker-unavailable"
+	codeTimeout           = "timeout"
+	codeSendFailed        = "send-failed"
+)
+
+// problemContentType is the content-type of a problem (RFC 7807)
+const problemContentType = "application/problem+json"
+
+var errNotConnected = stringError("producer is not connected")
+
+// problem is a 'problem details' body (RFC 7807) returned on errors
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (p *problem) StatusCode() int {
+	return p.Status
+}
+
+func (p *problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Title + ": " + p.Detail
+}
+
+func newProblem(status int, code string, err error) *problem {
+	p := &problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+	}
+	if err != nil {
+		p.Detail = err.Error()
+	}
+	return p
+}
+
+// sendProblem classifies an error from the message-broker
+func sendProblem(err error) *problem {
+	var p *problem
+	if errors.As(err, &p) {
+		return p
+	}
+
+	status, code := classifySendError(err)
+	return newProblem(status, code, err)
+}
+
+func classifySendError(err error) (int, string) {
+	var cfgErr sarama.ConfigurationError
+	if errors.As(err, &cfgErr) && strings.Contains(string(cfgErr), "MaxMessageBytes") {
+		return http.StatusRequestEntityTooLarge, codeMessageTooLarge
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, sarama.ErrMessageSizeTooLarge):
+		return http.StatusRequestEntityTooLarge, codeMessageTooLarge
+
+	case errors.Is(err, sarama.ErrRequestTimedOut),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, codeTimeout
+
+	case errors.Is(err, errNotConnected),
+		errors.Is(err, sarama.ErrOutOfBrokers),
+		errors.Is(err, sarama.ErrNotConnected),
+		errors.Is(err, sarama.ErrClosedClient),
+		errors.Is(err, sarama.ErrShuttingDown),
+		errors.Is(err, sarama.ErrLeaderNotAvailable),
+		errors.Is(err, sarama.ErrNotLeaderForPartition),
+		errors.Is(err, sarama.ErrNotEnoughReplicas),
+		errors.Is(err, sarama.ErrNotEnoughReplicasAfterAppend),
+		errors.As(err, &netErr):
+		return http.StatusServiceUnavailable, codeBrokerUnavailable
+	}
+
+	return http.StatusBadGateway, codeSendFailed
+}
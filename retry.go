@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// Backoff-strategies of a retry-policy
+const (
+	backoffConstant    = "constant"
+	backoffExponential = "exponential"
+	backoffJitter      = "jitter"
+)
+
+// the same as the shared 'netClient'
+const (
+	defaultRetryAttempts = 6
+	defaultRetryWaitMin  = 500 * time.Millisecond
+	defaultRetryWaitMax  = 3 * time.Second
+)
+
+// retryPolicy is how a callback is retried
+type retryPolicy struct {
+	MaxAttempts int           `json:"maxAttempts" yaml:"maxAttempts"`
+	Backoff     string        `json:"backoff" yaml:"backoff"`
+	MinWait     time.Duration `json:"minWait" yaml:"minWait"`
+	MaxWait     time.Duration `json:"maxWait" yaml:"maxWait"`
+	MaxElapsed  time.Duration `json:"maxElapsed" yaml:"maxElapsed"`
+	Timeout     time.Duration `json:"timeout" yaml:"timeout"`
+
+	Retryable []int `json:"retryable" yaml:"retryable"`
+	Terminal  []int `json:"terminal" yaml:"terminal"`
+	Skip      []int `json:"skip" yaml:"skip"`
+}
+
+func (rp *retryPolicy) Validate(name string) []error {
+	var errs []error
+
+	if rp.MaxAttempts == 0 {
+		rp.MaxAttempts = defaultRetryAttempts
+	}
+	if rp.MaxAttempts < 0 {
+		errs = append(errs, invalidError(name+".maxAttempts"))
+	}
+
+	switch rp.Backoff {
+	case "":
+		rp.Backoff = backoffExponential
+	case backoffConstant, backoffExponential, backoffJitter:
+	default:
+		errs = append(errs, invalidError(name+".backoff"))
+	}
+
+	if rp.MinWait == 0 {
+		rp.MinWait = defaultRetryWaitMin
+	}
+	if rp.MaxWait == 0 {
+		rp.MaxWait = defaultRetryWaitMax
+	}
+	if rp.MinWait < 0 || rp.MaxWait < rp.MinWait {
+		errs = append(errs, fmt.Errorf("'%s.minWait' and '%s.maxWait' are invalid", name, name))
+	}
+	if rp.MaxElapsed < 0 {
+		errs = append(errs, invalidError(name+".maxElapsed"))
+	}
+	if rp.Timeout < 0 {
+		errs = append(errs, invalidError(name+".timeout"))
+	}
+
+	// a status can only be in one of the lists
+	seen := make(map[int]string)
+	for _, list := range []struct {
+		name  string
+		codes []int
+	}{{"retryable", rp.Retryable}, {"terminal", rp.Terminal}, {"skip", rp.Skip}} {
+		for _, code := range list.codes {
+			if code < 100 || code > 599 {
+				errs = append(errs, fmt.Errorf("'%s.%s': invalid status %d", name, list.name, code))
+			}
+			if prev, ok := seen[code]; ok {
+				errs = append(errs, fmt.Errorf("'%s': status %d is both '%s' and '%s'", name, code, prev, list.name))
+			}
+			seen[code] = list.name
+		}
+	}
+
+	return errs
+}
+
+func hasStatus(codes []int, status int) bool {
+	for _, code := range codes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSkipped is true for responses that are accepted without being successful
+func (rp *retryPolicy) IsSkipped(status int) bool {
+	return rp != nil && hasStatus(rp.Skip, status)
+}
+
+// IsTerminal is true for responses that will never succeed
+func (rp *retryPolicy) IsTerminal(status int) bool {
+	return rp != nil && hasStatus(rp.Terminal, status)
+}
+
+// NewClient creates an http-client that follows the policy
+func (rp *retryPolicy) NewClient() *retryablehttp.Client {
+	client := retryablehttp.NewClient()
+	client.Logger = new(httpLogger)
+	client.RetryMax = rp.MaxAttempts - 1
+	client.RetryWaitMin = rp.MinWait
+	client.RetryWaitMax = rp.MaxWait
+	client.HTTPClient.Timeout = rp.Timeout
+	client.CheckRetry = rp.checkRetry
+	// keep the last response, so that its status can be reported
+	client.ErrorHandler = retryablehttp.PassthroughErrorHandler
+
+	switch rp.Backoff {
+	case backoffConstant:
+		client.Backoff = func(min, _ time.Duration, _ int, _ *http.Response) time.Duration {
+			return min
+		}
+	case backoffJitter:
+		// "full jitter", a random wait up to the exponential backoff
+		client.Backoff = func(min, max time.Duration, attempt int, _ *http.Response) time.Duration {
+			limit := float64(min) * math.Pow(2, float64(attempt))
+			if limit > float64(max) {
+				limit = float64(max)
+			}
+			return min + time.Duration(rand.Float64()*(limit-float64(min)))
+		}
+	default:
+		client.Backoff = retryablehttp.DefaultBackoff
+	}
+
+	return client
+}
+
+func (rp *retryPolicy) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil || resp == nil {
+		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	}
+
+	switch {
+	case hasStatus(rp.Skip, resp.StatusCode), hasStatus(rp.Terminal, resp.StatusCode):
+		return false, nil
+	case hasStatus(rp.Retryable, resp.StatusCode):
+		return true, nil
+	case len(rp.Retryable) > 0:
+		return false, nil
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// Context limits the total time of all attempts (if 'maxElapsed' is set)
+func (rp *retryPolicy) Context() (context.Context, context.CancelFunc) {
+	if rp == nil || rp.MaxElapsed == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), rp.MaxElapsed)
+}
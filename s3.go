@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3Timeout = 60 * time.Second
+
+// s3Config is an S3-compatible object-store (like AWS S3 or MinIO), using path-style URLs
+type s3Config struct {
+	Endpoint     string `json:"endpoint" yaml:"endpoint"`
+	Region       string `json:"region" yaml:"region"`
+	Bucket       string `json:"bucket" yaml:"bucket"`
+	Prefix       string `json:"prefix" yaml:"prefix"`
+	AccessKey    string `json:"accessKey" yaml:"accessKey"`
+	SecretKey    string `json:"secretKey" yaml:"secretKey"`
+	SessionToken string `json:"sessionToken" yaml:"sessionToken"`
+}
+
+func (cfg *s3Config) Validate(name string) []error {
+	var errs []error
+
+	if cfg.Endpoint == "" {
+		errs = append(errs, requiredError(name+".endpoint"))
+	} else if u, err := url.Parse(cfg.Endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, invalidError(name+".endpoint"))
+	}
+	if cfg.Bucket == "" {
+		errs = append(errs, requiredError(name+".bucket"))
+	}
+	if cfg.AccessKey == "" {
+		errs = append(errs, requiredError(name+".accessKey"))
+	}
+	if cfg.SecretKey == "" {
+		errs = append(errs, requiredError(name+".secretKey"))
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	return errs
+}
+
+// s3Store keeps blobs in an S3-bucket
+type s3Store struct {
+	cfg    *s3Config
+	client *http.Client
+}
+
+func newS3Store(cfg *s3Config) *s3Store {
+	return &s3Store{
+		cfg:    cfg,
+		client: &http.Client{Timeout: s3Timeout},
+	}
+}
+
+func (store *s3Store) Put(key string, data []byte) error {
+	resp, err := store.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (store *s3Store) Get(key string) ([]byte, error) {
+	resp, err := store.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (store *s3Store) do(method, key string, data []byte) (*http.Response, error) {
+	target := strings.TrimSuffix(store.cfg.Endpoint, "/") + "/" + store.cfg.Bucket + "/" + store.cfg.Prefix + key
+	req, err := http.NewRequest(method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(data))
+	if store.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", store.cfg.SessionToken)
+	}
+	signV4(req, data, store.cfg, time.Now())
+
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s '%s': %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// signV4 signs the request with AWS Signature Version 4 (all headers that are set are signed)
+func signV4(req *http.Request, payload []byte, cfg *s3Config, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes each segment of the path (RFC 3986), but keeps the '/'
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3Escape(s string) string {
+	var buf strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
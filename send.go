@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/ninlil/butler/log"
@@ -11,58 +14,354 @@ import (
 )
 
 type sendArgs struct {
-	ID string `from:"path" json:"id" required:""`
+	ID    string `from:"path" json:"id" required:""`
+	Topic string `from:"path" json:"topic"`
+	Key   string `from:"path" json:"key"`
+}
+
+// Melp-headers that control how a message is sent (and are not passed through)
+var melpControlHeaders = map[string]bool{
+	TOPIC:     true,
+	PARTITION: true,
+	TOMBSTONE: true,
+	TIMESTAMP: true,
 }
 
 var (
 	errNoSuchProducer = fmt.Errorf("no such output")
+	errEmptyBatch     = stringError("batch contains no messages")
+	errNoSuchMessage  = stringError("no such message")
+	errTombstoneBody  = stringError("a tombstone can't have a body")
+	errBodyTooLarge   = stringError("the body is larger than the producer allows")
 )
 
-func send(args *sendArgs, r *http.Request) (interface{}, int, error) {
-	p := config.outputs[args.ID]
+// findProducer returns the (authorized) producer to use
+func findProducer(id string, r *http.Request) (Producer, *problem) {
+	p := config.outputs[id]
 
 	if p == nil {
-		return nil, http.StatusBadRequest, errNoSuchProducer
+		return nil, newProblem(http.StatusNotFound, codeNoSuchProducer, errNoSuchProducer)
 	}
 
 	if ok, err := p.Authorize(r); !ok {
 		if err != nil {
 			log.Warn().Msgf("Auth failure '%s': %v", p.Name(), err)
 		}
-		return nil, http.StatusUnauthorized, nil
+		return nil, newProblem(http.StatusUnauthorized, codeUnauthorized, nil)
+	}
+
+	return p, nil
+}
+
+// reply sends the response with the status it asks for (or 200 OK)
+func reply(w http.ResponseWriter, response interface{}) (interface{}, int, error) {
+	if _, ok := response.(*problem); ok {
+		w.Header().Set("Content-Type", problemContentType)
+	}
+	if sc, ok := response.(statusCoder); ok {
+		return response, sc.StatusCode(), nil
 	}
+	return response, http.StatusOK, nil
+}
+
+func send(args *sendArgs, w http.ResponseWriter, r *http.Request) (interface{}, int, error) {
+	p, prob := findProducer(args.ID, r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+
+	release, prob := throttle(p, w, r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+	defer release()
+
+	return idempotent(p, w, r, func() (interface{}, int, error) {
+		return sendMessage(p, args, w, r)
+	})
+}
 
+func sendMessage(p Producer, args *sendArgs, w http.ResponseWriter, r *http.Request) (interface{}, int, error) {
 	log.Trace().Msgf("Send to '%s' (%s):", args.ID, p.Name())
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Error().Msgf("error reading body: %v", err)
+	body, prob := readBody(w, r, p.MaxBodyBytes())
+	if prob != nil {
+		return reply(w, prob)
 	}
-	defer r.Body.Close()
 
-	msg := Message{Body: body}
+	msg := newRequestMessage(r)
+	msg.AddMetadata(TOPIC, requestTopic(args, r))
+	msg.AddMetadata(PartitionKey, args.Key)
+	msg.Body = body
 
-	msg.AddHeader("X-Request-Id", router.ReqIDFromRequest(r))
-	msg.AddHeader("X-Correlation-Id", router.CorrIDFromRequest(r))
+	timestamp, prob := requestTimestamp(r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+	msg.Timestamp = timestamp
 
-	for _, h := range passthruHeaders {
-		msg.AddHeader(h, r.Header.Get(h))
+	if isTombstone(r) {
+		if len(body) > 0 {
+			return reply(w, newProblem(http.StatusBadRequest, codeInvalidRequest, errTombstoneBody))
+		}
+		msg.AddMetadata(TOMBSTONE, "true")
 	}
+
+	inEnvelope := isEnvelope(r)
+	rules := p.HeaderRules()
 	hdrs := map[string][]string(r.Header)
 	for key, vs := range hdrs {
-		if len(vs) > 0 {
-			key = strings.ToLower(key)
-			if strings.HasPrefix(key, "melp-") {
-				key = key[5:]
-				msg.AddHeader(key, vs[len(vs)-1])
+		if len(vs) == 0 {
+			continue
+		}
+		lower := strings.ToLower(key)
+		if inEnvelope && lower == "content-type" {
+			// the content-type of the message is in the envelope
+			continue
+		}
+		if strings.HasPrefix(lower, "melp-") {
+			key = lower[5:]
+			// the retry-headers are only set by consumers (and 'Melp-Melp-Retry-*' would be sent as one)
+			if melpControlHeaders[key] || strings.HasPrefix(key, "retry-") || isRetryHeader(key) || rules.Denied(key) {
+				continue
 			}
+		} else if !rules.Passes(key, isPassthruHeader(key)) {
+			continue
+		}
+		// all values are kept (in order), replacing any default value
+		msg.DelHeader(key)
+		for _, v := range vs {
+			msg.AddHTTPHeader(key, v)
 		}
 	}
 
+	if inEnvelope {
+		var env envelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			return reply(w, newProblem(http.StatusBadRequest, codeInvalidRequest, err))
+		}
+		if prob := env.Apply(&msg, rules); prob != nil {
+			return reply(w, prob)
+		}
+	}
+
+	rules.Transform(&msg, requestContext(p, &msg, r))
+
 	response, err := p.Send(msg, r)
 	if err != nil {
 		log.Error().Msgf("error sending msg: %v", err)
+		return reply(w, sendProblem(err))
+	}
+
+	return reply(w, response)
+}
+
+type statusArgs struct {
+	ID        string `from:"path" json:"id" required:""`
+	MessageID string `from:"path" json:"msgid" required:""`
+}
+
+// sendStatus returns the delivery-status of a message sent in async-mode
+func sendStatus(args *statusArgs, w http.ResponseWriter, r *http.Request) (interface{}, int, error) {
+	p, prob := findProducer(args.ID, r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+
+	status := p.Delivery(args.MessageID)
+	if status == nil {
+		return reply(w, newProblem(http.StatusNotFound, codeNoSuchMessage, errNoSuchMessage))
+	}
+	return status, http.StatusOK, nil
+}
+
+type batchResponse struct {
+	Failed  int           `json:"failed"`
+	Results []batchResult `json:"results"`
+}
+
+func sendBatch(args *sendArgs, w http.ResponseWriter, r *http.Request) (interface{}, int, error) {
+	p, prob := findProducer(args.ID, r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+
+	release, prob := throttle(p, w, r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+	defer release()
+
+	return idempotent(p, w, r, func() (interface{}, int, error) {
+		return sendMessages(p, args, w, r)
+	})
+}
+
+func sendMessages(p Producer, args *sendArgs, w http.ResponseWriter, r *http.Request) (interface{}, int, error) {
+	log.Trace().Msgf("Send batch to '%s' (%s):", args.ID, p.Name())
+
+	defer r.Body.Close()
+	limit := p.MaxBatchBytes()
+	if r.ContentLength > limit {
+		return reply(w, newProblem(http.StatusRequestEntityTooLarge, codeMessageTooLarge, errBodyTooLarge))
+	}
+	items, err := readBatch(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		return reply(w, bodyProblem(err))
+	}
+
+	topic := requestTopic(args, r)
+	timestamp, prob := requestTimestamp(r)
+	if prob != nil {
+		return reply(w, prob)
+	}
+
+	rules := p.HeaderRules()
+	msgs := make([]Message, 0, len(items))
+	for i, item := range items {
+		msg := newRequestMessage(r)
+		msg.AddMetadata(TOPIC, topic)
+		msg.Timestamp = timestamp
+		if prob := item.Apply(&msg, rules); prob != nil {
+			prob.Detail = fmt.Sprintf("message #%d: %s", i, prob.Detail)
+			return reply(w, prob)
+		}
+		rules.Transform(&msg, requestContext(p, &msg, r))
+		msgs = append(msgs, msg)
+	}
+
+	results, err := p.SendBatch(msgs, r)
+	if err != nil {
+		log.Error().Msgf("error sending batch: %v", err)
+		return reply(w, sendProblem(err))
 	}
 
+	var accepted bool
+	response := &batchResponse{Results: results}
+	for _, res := range results {
+		if res.Error != "" {
+			response.Failed++
+		}
+		if res.ID != "" {
+			accepted = true
+		}
+	}
+
+	if response.Failed > 0 {
+		return response, http.StatusMultiStatus, nil
+	}
+	if accepted {
+		return response, http.StatusAccepted, nil
+	}
 	return response, http.StatusOK, nil
 }
+
+// readBody reads the whole body, a body larger than 'limit' is rejected before it is buffered
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, *problem) {
+	defer r.Body.Close()
+
+	if r.ContentLength > limit {
+		return nil, newProblem(http.StatusRequestEntityTooLarge, codeMessageTooLarge, errBodyTooLarge)
+	}
+
+	// a truncated upload is an error (io.ErrUnexpectedEOF), never a shorter message
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		log.Error().Msgf("error reading body: %v", err)
+		return nil, bodyProblem(err)
+	}
+	return body, nil
+}
+
+// bodyProblem is the problem for an error reading the body
+func bodyProblem(err error) *problem {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return newProblem(http.StatusRequestEntityTooLarge, codeMessageTooLarge, errBodyTooLarge)
+	}
+	return newProblem(http.StatusBadRequest, codeInvalidRequest, err)
+}
+
+// readBatch parses either a JSON-array or a stream of JSON-objects (NDJSON)
+func readBatch(body io.Reader) ([]envelope, error) {
+	var items []envelope
+
+	dec := json.NewDecoder(body)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil, errEmptyBatch
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		for dec.More() {
+			var item envelope
+			if err := dec.Decode(&item); err != nil {
+				return nil, fmt.Errorf("message #%d: %w", len(items), err)
+			}
+			items = append(items, item)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+
+	case json.Delim('{'):
+		// NDJSON: the first '{' is already consumed, so re-read from the buffered start
+		dec = json.NewDecoder(io.MultiReader(strings.NewReader("{"), dec.Buffered(), body))
+		for {
+			var item envelope
+			err := dec.Decode(&item)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("message #%d: %w", len(items), err)
+			}
+			items = append(items, item)
+		}
+
+	default:
+		return nil, stringError("batch must be a JSON-array or NDJSON")
+	}
+
+	if len(items) == 0 {
+		return nil, errEmptyBatch
+	}
+	return items, nil
+}
+
+// requestTopic returns the topic the caller selected (path or 'Melp-Topic' header)
+func requestTopic(args *sendArgs, r *http.Request) string {
+	if args.Topic != "" {
+		return args.Topic
+	}
+	return r.Header.Get("Melp-Topic")
+}
+
+// isTombstone is true for 'DELETE /send/{id}/{key}' or the header 'Melp-Tombstone: true'
+func isTombstone(r *http.Request) bool {
+	if r.Method == http.MethodDelete {
+		return true
+	}
+	tombstone, _ := strconv.ParseBool(r.Header.Get("Melp-Tombstone"))
+	return tombstone
+}
+
+// newRequestMessage creates a message with the request- and correlation-id of the request
+func newRequestMessage(r *http.Request) Message {
+	var msg Message
+	msg.AddHeader("X-Request-Id", router.ReqIDFromRequest(r))
+	msg.AddHeader("X-Correlation-Id", router.CorrIDFromRequest(r))
+	msg.AddMetadata(PARTITION, r.Header.Get("Melp-Partition"))
+	return msg
+}
+
+// requestContext is the context header-rules are evaluated in
+func requestContext(p Producer, msg *Message, r *http.Request) *messageContext {
+	mc := newMessageContext(msg, r)
+	mc.identity = p.Identity(r)
+	return mc
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// messageContext is what templates and rules are evaluated against
+type messageContext struct {
+	msg      *Message
+	r        *http.Request
+	identity string
+
+	parsed bool
+	doc    interface{}
+}
+
+func newMessageContext(msg *Message, r *http.Request) *messageContext {
+	return &messageContext{msg: msg, r: r}
+}
+
+// Header returns a header from the request (or the message if there is no request)
+func (mc *messageContext) Header(key string) string {
+	if mc.r != nil {
+		if v := mc.r.Header.Get(key); v != "" {
+			return v
+		}
+	}
+	return mc.msg.GetHeader(key)
+}
+
+// Metadata returns metadata of the message (like 'topic' when consuming)
+func (mc *messageContext) Metadata(key string) string {
+	return mc.msg.Metadata[key]
+}
+
+// RemoteAddr returns the address of the caller
+func (mc *messageContext) RemoteAddr() string {
+	if mc.r == nil {
+		return ""
+	}
+	return clientIP(mc.r)
+}
+
+// Query returns a query-parameter from the request
+func (mc *messageContext) Query(key string) string {
+	if mc.r == nil {
+		return ""
+	}
+	return mc.r.URL.Query().Get(key)
+}
+
+// Document returns the body parsed as JSON (or nil if it isn't JSON)
+func (mc *messageContext) Document() interface{} {
+	if !mc.parsed {
+		mc.parsed = true
+		dec := json.NewDecoder(bytes.NewReader(mc.msg.Body))
+		dec.UseNumber()
+		if err := dec.Decode(&mc.doc); err != nil {
+			mc.doc = nil
+		}
+	}
+	return mc.doc
+}
+
+// Field returns the value of a JSON-pointer (RFC 6901) into the body
+func (mc *messageContext) Field(pointer string) (string, bool) {
+	v, ok := jsonPointer(mc.Document(), pointer)
+	if !ok {
+		return "", false
+	}
+	return jsonText(v), true
+}
+
+// Data is what the template can access as '.name', the top-level fields of a JSON-body and some extras
+func (mc *messageContext) Data() map[string]interface{} {
+	data := make(map[string]interface{})
+	if obj, ok := mc.Document().(map[string]interface{}); ok {
+		for k, v := range obj {
+			data[k] = jsonText(v)
+		}
+	}
+	now := time.Now().UTC()
+	data["date"] = now.Format("2006-01-02")
+	data["time"] = now.Format("15:04:05")
+	return data
+}
+
+func (mc *messageContext) funcs() template.FuncMap {
+	return template.FuncMap{
+		"header":   mc.Header,
+		"query":    mc.Query,
+		"metadata": mc.Metadata,
+		"identity": func() string {
+			return mc.identity
+		},
+		"remoteAddr": mc.RemoteAddr,
+		"field": func(pointer string) string {
+			v, _ := mc.Field(pointer)
+			return v
+		},
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+}
+
+// messageTemplate is a text/template that is evaluated against a message
+type messageTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+// placeholder functions, used when parsing (the real ones are bound when executed)
+var templateFuncs = (&messageContext{msg: &Message{}}).funcs()
+
+func newMessageTemplate(name, text string) (*messageTemplate, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &messageTemplate{text: text, tmpl: tmpl}, nil
+}
+
+// Execute the template, missing fields are errors
+func (mt *messageTemplate) Execute(mc *messageContext) (string, error) {
+	tmpl, err := mt.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Funcs(mc.funcs()).Execute(&buf, mc.Data()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// jsonPointer resolves a JSON-pointer (RFC 6901) in a parsed JSON-document
+func jsonPointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return doc, doc != nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+
+	cur := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, cur != nil
+}
+
+// jsonText returns a JSON-value as text (strings without quotes)
+func jsonText(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case nil:
+		return ""
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}